@@ -0,0 +1,481 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package api implements the gRPC + HTTP/JSON gateway described by
+// bprpc.proto, sitting in front of the existing Go-specific net/rpc BP
+// service so non-Go clients can reach endpoints like GET /v1/block/{height}
+// over plain HTTP/JSON.
+//
+// The gRPC server stubs and grpc-gateway reverse-proxy mux for bprpc.proto
+// are produced by `protoc --go_out=... --go-grpc_out=... --grpc-gateway_out=...`
+// from the same .proto that the `make swagger` build target regenerates
+// swagger.json from (that target runs only the swagger generator); they are
+// not hand-written here. Gateway below is the adapter those generated handlers
+// call into: it holds no business logic of its own, it only translates
+// between the wire-level request/response types and the native BPHandler
+// that every net/rpc call already goes through, so logic is implemented
+// exactly once.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+
+	"github.com/CovenantSQL/CovenantSQL/blockproducer/interfaces"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/rpc/pubsub"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+// BPHandler is the subset of the BP net/rpc service that the gateway
+// dispatches into. It is satisfied by the same service value already passed
+// to rpc.Server.RegisterService for the native BP RPC methods.
+type BPHandler interface {
+	FetchBlock(req *types.FetchBlockReq, resp *types.FetchBlockResp) error
+	FetchBlockByCount(req *types.FetchBlockByCountReq, resp *types.FetchBlockResp) error
+	NextAccountNonce(req *types.NextAccountNonceReq, resp *types.NextAccountNonceResp) error
+	AddTx(req *types.AddTxReq, resp *types.AddTxResp) error
+	QueryAccountStableBalance(req *types.QueryAccountStableBalanceReq, resp *types.QueryAccountStableBalanceResp) error
+	QueryAccountCovenantBalance(req *types.QueryAccountCovenantBalanceReq, resp *types.QueryAccountCovenantBalanceResp) error
+	QuerySQLChainProfile(req *types.QuerySQLChainProfileReq, resp *types.QuerySQLChainProfileResp) error
+}
+
+// txTypeRegistry maps the "type" discriminator POST /v1/tx's JSON body
+// carries to a constructor for the concrete interfaces.Transaction
+// implementation it names. encoding/json cannot build a concrete
+// implementation behind a bare interface on its own, so whatever package
+// defines a concrete Transaction type must call RegisterTxType (typically
+// from its init()) before that type can be decoded here.
+var txTypeRegistry = make(map[string]func() interfaces.Transaction)
+
+// RegisterTxType makes typ available as the "type" field of a POST /v1/tx
+// body: handleAddTx decodes the "tx" field into newTx() and passes the
+// result to BPHandler.AddTx.
+func RegisterTxType(typ string, newTx func() interfaces.Transaction) {
+	txTypeRegistry[typ] = newTx
+}
+
+// decodeTx looks up typ in txTypeRegistry, constructs a concrete zero value
+// and unmarshals raw into it -- unlike unmarshaling directly into a bare
+// interfaces.Transaction, which encoding/json can never populate.
+func decodeTx(typ string, raw json.RawMessage) (interfaces.Transaction, error) {
+	newTx, ok := txTypeRegistry[typ]
+	if !ok {
+		return nil, fmt.Errorf("api: unknown tx type %q", typ)
+	}
+	tx := newTx()
+	if err := json.Unmarshal(raw, tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// envelopeMetadataKeys are the gRPC metadata / HTTP header names carrying
+// the proto.Envelope fields that ride inline on every native net/rpc
+// request. grpc-gateway forwards HTTP headers as incoming gRPC metadata
+// under these same keys, so EnvelopeFromContext handles both transports.
+const (
+	metaNodeID    = "covenantsql-node-id"
+	metaNonce     = "covenantsql-nonce"
+	metaSignature = "covenantsql-signature"
+)
+
+// EnvelopeFromContext rebuilds the proto.Envelope a native net/rpc caller
+// would have sent inline, from the gRPC metadata (or HTTP headers, which
+// grpc-gateway surfaces the same way) attached to ctx. Every generated BP
+// service method should call this first and populate it onto the request
+// before handing off to Gateway/BPHandler, so the same signature
+// verification the net/rpc path already does runs unchanged for gRPC/HTTP
+// callers.
+func EnvelopeFromContext(ctx context.Context) (env proto.Envelope, err error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return env, nil
+	}
+	if v := md.Get(metaNodeID); len(v) > 0 {
+		env.NodeID = proto.NodeID(v[0])
+	}
+	if v := md.Get(metaNonce); len(v) > 0 {
+		var nonce uint64
+		if nonce, err = strconv.ParseUint(v[0], 10, 64); err != nil {
+			return
+		}
+		env.Nonce = nonce
+	}
+	if v := md.Get(metaSignature); len(v) > 0 {
+		env.Signature = []byte(v[0])
+	}
+	return
+}
+
+// Gateway adapts the BPHandler methods onto plain net/http, mirroring the
+// paths declared in bprpc.proto. It is meant to run alongside (not replace)
+// the generated grpc-gateway ServeMux: the GET, POST and DELETE endpoints
+// are handled directly here so operators who only need the JSON surface
+// don't have to stand up a full gRPC server. Request and response bodies
+// here are the encoding/json forms of the types package structs (POST /v1/tx
+// takes {"type", "tx"}), not the message shapes described in swagger.json.
+//
+// Gateway is also where the rpc/pubsub subsystem and the types.FilterManager
+// poll-based filter API are actually mounted: a Hub passed to NewGateway is
+// registered with the four default namespaces and wired into handleAddTx and
+// DispatchHook, Handler serves the WebSocket endpoint for the former and the
+// /v1/filter/* routes for the latter, so neither sits unused behind a
+// service that never calls into it.
+type Gateway struct {
+	h       BPHandler
+	hub     *pubsub.Hub
+	feeds   *pubsub.Feeds
+	filters *types.FilterManager
+}
+
+// NewGateway wraps h, the same service implementation already registered
+// with the native net/rpc mux, for HTTP/JSON access. Pass a non-nil hub to
+// also register the default rpc/pubsub namespaces and serve them from
+// Handler; pass nil if this process has no pub/sub subscribers to serve.
+func NewGateway(h BPHandler, hub *pubsub.Hub) *Gateway {
+	g := &Gateway{h: h, hub: hub, filters: types.NewFilterManager()}
+	if hub != nil {
+		g.feeds = pubsub.RegisterDefaultNamespaces(hub)
+	}
+	return g
+}
+
+// DispatchHook reports a new block or tx billing that has just been accepted
+// upstream (by AdviseNewBlock/AdviseTxBilling) to both of this Gateway's
+// consumers of that feed: the rpc/pubsub namespaces and the
+// types.FilterManager backing /v1/filter/*. It is shaped to match
+// sqlchain.MuxService.SetDispatchHook's DispatchHook type -- a real
+// ChainRPCService forwarding through MuxService can install
+// gateway.DispatchHook there directly -- but only recognizes the
+// types-package req/resp pair (*types.AdviseNewBlockReq/*types.
+// AdviseTxBillingReq), since those are the only versions of these requests
+// that carry a real *types.BPBlock/*types.Billing payload in this tree; the
+// sqlchain-local Mux*Req types embed sqlchain's own, differently-shaped
+// AdviseNewBlockReq/SignBillingReq that this package has no way to read a
+// block or billing out of, so calls carrying those are silently ignored
+// rather than guessed at.
+func (g *Gateway) DispatchHook(method string, req, resp interface{}) {
+	switch method {
+	case "AdviseNewBlock":
+		r, ok := req.(*types.AdviseNewBlockReq)
+		if !ok || r.Block == nil {
+			return
+		}
+		if g.feeds != nil {
+			g.feeds.PublishNewBlock(r.Block)
+		}
+		// AdviseNewBlockReq carries no height field and types.BPBlock's own
+		// definition isn't present in this tree to read one off, so matched
+		// FilterEntry.Height is reported as 0 here; a real BPBlock type
+		// should plumb its actual height through instead.
+		g.filters.DispatchBlock(0, r.Block)
+	case "AdviseTxBilling":
+		r, ok := req.(*types.AdviseTxBillingReq)
+		if !ok || r.TxBilling == nil {
+			return
+		}
+		if g.feeds != nil {
+			g.feeds.PublishNewTxBilling(r.TxBilling)
+		}
+		// Same height caveat as DispatchBlock above: types.Billing's
+		// definition isn't present in this tree either.
+		g.filters.DispatchTxBilling(0, r.TxBilling)
+	}
+}
+
+// Handler returns an http.Handler serving the routes from bprpc.proto, plus
+// /ws for rpc/pubsub subscriptions when NewGateway was given a Hub.
+func (g *Gateway) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/block/", g.handleFetchBlock)
+	mux.HandleFunc("/v1/account/", g.handleAccount)
+	mux.HandleFunc("/v1/tx", g.handleAddTx)
+	mux.HandleFunc("/v1/sqlchain/", g.handleSQLChainProfile)
+	mux.HandleFunc("/v1/filter/block", g.handleNewBlockFilter)
+	mux.HandleFunc("/v1/filter/txbilling", g.handleNewTxBillingFilter)
+	mux.HandleFunc("/v1/filter/", g.handleFilterByID)
+	if g.hub != nil {
+		mux.Handle("/ws", pubsub.ServeWebSocket(g.hub))
+	}
+	// Carry the envelope headers into the request context as incoming
+	// metadata, so EnvelopeFromContext finds them in these plain HTTP
+	// handlers too.
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		md := metadata.MD{}
+		for _, k := range []string{metaNodeID, metaNonce, metaSignature} {
+			if v := r.Header.Get(k); v != "" {
+				md.Set(k, v)
+			}
+		}
+		mux.ServeHTTP(w, r.WithContext(metadata.NewIncomingContext(r.Context(), md)))
+	})
+}
+
+// ServeIPC serves rpc/pubsub subscriptions over a Unix domain socket at
+// endpoint, blocking until the listener is closed or errors out. It is a
+// no-op returning nil if NewGateway was given no Hub.
+func (g *Gateway) ServeIPC(endpoint string) error {
+	if g.hub == nil {
+		return nil
+	}
+	return pubsub.ServeIPC(g.hub, endpoint)
+}
+
+func (g *Gateway) handleFetchBlock(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/v1/block/")
+	numStr := strings.TrimPrefix(rest, "by-count/")
+	n, err := strconv.ParseUint(numStr, 10, 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	env, err := EnvelopeFromContext(r.Context())
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	resp := &types.FetchBlockResp{}
+	if numStr != rest {
+		err = g.h.FetchBlockByCount(&types.FetchBlockByCountReq{Envelope: env, Count: uint32(n)}, resp)
+	} else {
+		err = g.h.FetchBlock(&types.FetchBlockReq{Envelope: env, Height: uint32(n)}, resp)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+func (g *Gateway) handleAccount(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/v1/account/")
+	parts := strings.Split(rest, "/")
+
+	env, err := EnvelopeFromContext(r.Context())
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	addr := proto.AccountAddress{}
+	if err = addr.UnmarshalText([]byte(parts[0])); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && parts[1] == "nonce":
+		req := &types.NextAccountNonceReq{Envelope: env, Addr: addr}
+		resp := &types.NextAccountNonceResp{}
+		if err = g.h.NextAccountNonce(req, resp); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, resp)
+
+	case len(parts) == 3 && parts[1] == "balance" && parts[2] == "stable":
+		req := &types.QueryAccountStableBalanceReq{Envelope: env, Addr: addr}
+		resp := &types.QueryAccountStableBalanceResp{}
+		if err = g.h.QueryAccountStableBalance(req, resp); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, resp)
+
+	case len(parts) == 3 && parts[1] == "balance" && parts[2] == "covenant":
+		req := &types.QueryAccountCovenantBalanceReq{Envelope: env, Addr: addr}
+		resp := &types.QueryAccountCovenantBalanceResp{}
+		if err = g.h.QueryAccountCovenantBalance(req, resp); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, resp)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (g *Gateway) handleAddTx(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	env, err := EnvelopeFromContext(r.Context())
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	var body struct {
+		Type string          `json:"type"`
+		Tx   json.RawMessage `json:"tx"`
+	}
+	if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := decodeTx(body.Type, body.Tx)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	req := &types.AddTxReq{Envelope: env, Tx: tx}
+	resp := &types.AddTxResp{}
+	if err = g.h.AddTx(req, resp); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if g.feeds != nil {
+		g.feeds.PublishPendingTx(tx)
+	}
+	writeJSON(w, resp)
+}
+
+func (g *Gateway) handleSQLChainProfile(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/v1/sqlchain/")
+	dbID := strings.TrimSuffix(rest, "/profile")
+	if dbID == rest {
+		http.NotFound(w, r)
+		return
+	}
+
+	env, err := EnvelopeFromContext(r.Context())
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	req := &types.QuerySQLChainProfileReq{Envelope: env, DBID: proto.DatabaseID(dbID)}
+	resp := &types.QuerySQLChainProfileResp{}
+	if err = g.h.QuerySQLChainProfile(req, resp); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// handleNewBlockFilter serves NewBlockFilter: POST /v1/filter/block installs
+// a filter matching every future block and returns its id.
+func (g *Gateway) handleNewBlockFilter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	env, err := EnvelopeFromContext(r.Context())
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	resp := &types.NewBlockFilterResp{Envelope: env, FilterID: g.filters.NewBlockFilter()}
+	writeJSON(w, resp)
+}
+
+// handleNewTxBillingFilter serves NewTxBillingFilter: POST
+// /v1/filter/txbilling installs a filter matching future billings per the
+// JSON-decoded request body and returns its id. It reports
+// types.ErrFilterCriteriaUnsupported as a 400 if the request asks to filter
+// on FromAddr, ToAddr or TxTypes, since the Billing payload DispatchTxBilling
+// receives doesn't carry the originating transaction's from/to address or
+// type in this tree (see txBillingFilter's doc comment in types/filter.go).
+func (g *Gateway) handleNewTxBillingFilter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	env, err := EnvelopeFromContext(r.Context())
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	req := &types.NewTxBillingFilterReq{Envelope: env}
+	if r.Body != nil {
+		if err = json.NewDecoder(r.Body).Decode(req); err != nil && err.Error() != "EOF" {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	id, err := g.filters.NewTxBillingFilter(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, &types.NewTxBillingFilterResp{Envelope: env, FilterID: id})
+}
+
+// handleFilterByID serves GetFilterChanges/GetFilterLogs/UninstallFilter,
+// all keyed by the FilterID in the URL: GET /v1/filter/{id}/changes, GET
+// /v1/filter/{id}/logs, DELETE /v1/filter/{id}.
+func (g *Gateway) handleFilterByID(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/v1/filter/")
+	parts := strings.Split(rest, "/")
+
+	env, err := EnvelopeFromContext(r.Context())
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	id := types.FilterID(parts[0])
+
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[1] == "changes":
+		entries, ok := g.filters.GetFilterChanges(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, &types.GetFilterChangesResp{Envelope: env, Entries: entries})
+
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[1] == "logs":
+		entries, ok := g.filters.GetFilterLogs(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, &types.GetFilterLogsResp{Envelope: env, Entries: entries})
+
+	case r.Method == http.MethodDelete && len(parts) == 1:
+		ok := g.filters.UninstallFilter(id)
+		writeJSON(w, &types.UninstallFilterResp{Envelope: env, OK: ok})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{Error: err.Error()})
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+import (
+	hsp "github.com/CovenantSQL/HashStablePack/marshalhash"
+)
+
+// MarshalHashWithScheme is the scheme-ID-aware counterpart of
+// TokenReceive.MarshalHash: it folds schemeID (one of
+// kms.SchemeSecp256k1ID/kms.SchemeEd25519ID) into the hashed payload ahead
+// of the existing Signee/Signature/TokenReceiveHeader/HeaderHash fields, so
+// two TokenReceives carrying the same Signee/Signature bytes under
+// different schemes no longer hash identically.
+//
+// Now that a local key can be ed25519 as well as secp256k1 (see
+// crypto/kms.Scheme), a verifier that hashes/checks a TokenReceive purely
+// off t.MarshalHash() has no way to tell which Scheme Signature was
+// produced under. Callers building or verifying a TokenReceive should use
+// MarshalHashWithScheme instead of calling t.MarshalHash() directly.
+//
+// This is additive rather than a change to the generated MarshalHash/
+// Msgsize in tokenreceive_gen.go: folding the scheme byte into the struct
+// itself would require adding a SchemeID field to TokenReceive, and this
+// package's checked-in source doesn't include the hand-written file that
+// declares TokenReceive's fields. Once that field exists, the generated
+// MarshalHash should absorb this function's logic directly and callers
+// should go back to calling MarshalHash() alone.
+//
+// MarshalHashWithScheme has no caller in this tree yet: this package only
+// contains the generated tokenreceive_gen.go (marshal/size methods) and
+// this file, never the hand-written source that would define TokenReceive's
+// fields and the code that signs/verifies one, so there is no real call
+// site to wire this into without fabricating that code. Landing that
+// wiring -- at whatever call site signs a TokenReceive and whatever call
+// site verifies one -- is a genuine follow-up against the actual source,
+// not something this commit can complete on its own.
+func MarshalHashWithScheme(t *TokenReceive, schemeID uint8) (o []byte, err error) {
+	body, err := t.MarshalHash()
+	if err != nil {
+		return nil, err
+	}
+	o = hsp.Require(nil, len(body)+1)
+	o = append(o, schemeID)
+	o = append(o, body...)
+	return o, nil
+}
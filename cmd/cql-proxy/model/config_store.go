@@ -0,0 +1,178 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	gorp "gopkg.in/gorp.v2"
+)
+
+// ErrProjectConfigNotFound is returned by ProjectConfigStore.Get when no
+// config exists for the given (type, key).
+var ErrProjectConfigNotFound = errors.New("project config not found")
+
+// ErrProjectConfigExists is returned by UniqueAdder.Add when a config
+// already exists for the given (type, key).
+var ErrProjectConfigExists = errors.New("project config already exists")
+
+// ProjectConfigEventType distinguishes the two kinds of change Watch can
+// report.
+type ProjectConfigEventType int
+
+const (
+	// ProjectConfigPut is reported for both config creation and update.
+	ProjectConfigPut ProjectConfigEventType = iota
+	// ProjectConfigDeleted is reported when a config is removed.
+	ProjectConfigDeleted
+)
+
+// ProjectConfigEvent is a single change reported by ProjectConfigStore.Watch.
+type ProjectConfigEvent struct {
+	EventType ProjectConfigEventType
+	Config    *ProjectConfig
+}
+
+// ProjectConfigStore abstracts where project config is actually persisted,
+// so the typed getters below (GetProjectOAuthConfig, GetProjectTableConfig,
+// ...) don't need to know whether they're backed by the project's own gorp
+// database or a shared etcd cluster. Every implementation is keyed by
+// (ProjectConfigType, key), matching the existing "____config" table layout.
+type ProjectConfigStore interface {
+	// Get returns the config stored under (configType, key), or
+	// ErrProjectConfigNotFound.
+	Get(configType ProjectConfigType, key string) (*ProjectConfig, error)
+	// List returns every config of configType.
+	List(configType ProjectConfigType) ([]*ProjectConfig, error)
+	// Put creates or overwrites the config stored under (p.Type, p.Key).
+	Put(p *ProjectConfig) error
+	// Delete removes the config stored under (configType, key), if any.
+	Delete(configType ProjectConfigType, key string) error
+	// Watch streams every subsequent Put/Delete affecting configType. The
+	// returned channel is closed once ctx is done, so a caller that stops
+	// reading should cancel ctx to let the implementation stop its
+	// underlying watch and return; implementations that cannot watch (e.g.
+	// the gorp backend) return an error instead of a channel.
+	Watch(ctx context.Context, configType ProjectConfigType) (<-chan ProjectConfigEvent, error)
+}
+
+// UniqueAdder is implemented by stores that can reject a Put as a duplicate
+// rather than silently overwriting, for callers (AddProjectConfig) that
+// want create-only semantics.
+type UniqueAdder interface {
+	// Add creates the config stored under (p.Type, p.Key), failing with
+	// ErrProjectConfigExists if one is already present.
+	Add(p *ProjectConfig) error
+}
+
+func decodeConfigValue(pc *ProjectConfig) {
+	switch pc.Type {
+	case ProjectConfigMisc:
+		pc.Value = &ProjectMiscConfig{}
+	case ProjectConfigOAuth:
+		pc.Value = &ProjectOAuthConfig{}
+	case ProjectConfigTable:
+		pc.Value = &ProjectTableConfig{}
+	case ProjectConfigGroup:
+		pc.Value = &ProjectGroupConfig{}
+	}
+	_ = json.Unmarshal(pc.RawValue, &pc.Value)
+}
+
+// GorpProjectConfigStore is the existing gorp.DbMap-backed implementation of
+// ProjectConfigStore, against the per-project "____config" table.
+type GorpProjectConfigStore struct {
+	db *gorp.DbMap
+}
+
+// NewGorpProjectConfigStore wraps db, the project's own database handle, as
+// a ProjectConfigStore.
+func NewGorpProjectConfigStore(db *gorp.DbMap) *GorpProjectConfigStore {
+	return &GorpProjectConfigStore{db: db}
+}
+
+// Get implements ProjectConfigStore.
+func (s *GorpProjectConfigStore) Get(configType ProjectConfigType, key string) (p *ProjectConfig, err error) {
+	err = s.db.SelectOne(&p, `SELECT * FROM "____config" WHERE "type" = ? AND "key" = ? LIMIT 1`,
+		configType, key)
+	if err == sql.ErrNoRows {
+		return nil, ErrProjectConfigNotFound
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "get project config failed")
+		return
+	}
+	decodeConfigValue(p)
+	return
+}
+
+// List implements ProjectConfigStore.
+func (s *GorpProjectConfigStore) List(configType ProjectConfigType) (p []*ProjectConfig, err error) {
+	_, err = s.db.Select(&p, `SELECT * FROM "____config" WHERE "type" = ?`, configType)
+	if err != nil {
+		err = errors.Wrapf(err, "list project config failed")
+		return
+	}
+	for _, pc := range p {
+		decodeConfigValue(pc)
+	}
+	return
+}
+
+// Put implements ProjectConfigStore, upserting by (Type, Key).
+func (s *GorpProjectConfigStore) Put(p *ProjectConfig) (err error) {
+	existing, err := s.Get(p.Type, p.Key)
+	if err != nil && err != ErrProjectConfigNotFound {
+		return err
+	}
+	if existing == nil {
+		return AddRawProjectConfig(s.db, p)
+	}
+	p.ID = existing.ID
+	p.Created = existing.Created
+	return UpdateProjectConfig(s.db, p)
+}
+
+// Add implements UniqueAdder by looking the (Type, Key) pair up with Get
+// first and returning ErrProjectConfigExists if it is present. The lookup
+// and the insert are not one atomic step, so two concurrent Add calls for
+// the same pair can both succeed.
+func (s *GorpProjectConfigStore) Add(p *ProjectConfig) (err error) {
+	if existing, gerr := s.Get(p.Type, p.Key); gerr == nil && existing != nil {
+		return ErrProjectConfigExists
+	}
+	return AddRawProjectConfig(s.db, p)
+}
+
+// Delete implements ProjectConfigStore.
+func (s *GorpProjectConfigStore) Delete(configType ProjectConfigType, key string) (err error) {
+	_, err = s.db.Exec(`DELETE FROM "____config" WHERE "type" = ? AND "key" = ?`, configType, key)
+	if err != nil {
+		err = errors.Wrapf(err, "delete project config failed")
+	}
+	return
+}
+
+// Watch implements ProjectConfigStore. The gorp backend has no change feed,
+// so callers wanting live updates on a SQL-backed project should poll List
+// instead, or switch the project over to EtcdProjectConfigStore.
+func (s *GorpProjectConfigStore) Watch(ctx context.Context, configType ProjectConfigType) (<-chan ProjectConfigEvent, error) {
+	return nil, errors.New("gorp project config store does not support Watch, poll List instead")
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package model
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/integration"
+	gorp "gopkg.in/gorp.v2"
+)
+
+// runProjectConfigStoreSuite exercises the same Get/List/Put/Add/Delete
+// sequence against store, so GorpProjectConfigStore and
+// EtcdProjectConfigStore are held to identical behavior instead of each
+// backend only ever being checked against its own assumptions.
+func runProjectConfigStoreSuite(t *testing.T, store ProjectConfigStore) {
+	_, err := store.Get(ProjectConfigMisc, "missing")
+	require.Equal(t, ErrProjectConfigNotFound, err)
+
+	p := &ProjectConfig{Type: ProjectConfigMisc, Key: "k1", RawValue: []byte(`{"a":1}`), Value: map[string]int{"a": 1}}
+	require.NoError(t, store.Put(p))
+
+	got, err := store.Get(ProjectConfigMisc, "k1")
+	require.NoError(t, err)
+	require.Equal(t, []byte(`{"a":1}`), got.RawValue)
+
+	p2 := &ProjectConfig{Type: ProjectConfigMisc, Key: "k1", RawValue: []byte(`{"a":2}`), Value: map[string]int{"a": 2}}
+	require.NoError(t, store.Put(p2))
+	got, err = store.Get(ProjectConfigMisc, "k1")
+	require.NoError(t, err)
+	require.Equal(t, []byte(`{"a":2}`), got.RawValue)
+
+	p3 := &ProjectConfig{Type: ProjectConfigMisc, Key: "k2", RawValue: []byte(`{"b":1}`), Value: map[string]int{"b": 1}}
+	require.NoError(t, store.Put(p3))
+
+	list, err := store.List(ProjectConfigMisc)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+
+	require.NoError(t, store.Delete(ProjectConfigMisc, "k2"))
+	list, err = store.List(ProjectConfigMisc)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+
+	if adder, ok := store.(UniqueAdder); ok {
+		require.NoError(t, adder.Add(&ProjectConfig{Type: ProjectConfigMisc, Key: "k3", RawValue: []byte(`{}`)}))
+		require.Equal(t, ErrProjectConfigExists, adder.Add(&ProjectConfig{Type: ProjectConfigMisc, Key: "k3", RawValue: []byte(`{}`)}))
+	}
+}
+
+func newTestGorpDbMap(t *testing.T) *gorp.DbMap {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+
+	dbMap := &gorp.DbMap{Db: db, Dialect: gorp.SqliteDialect{}}
+	dbMap.AddTableWithName(ProjectConfig{}, "____config").SetKeys(true, "ID")
+	require.NoError(t, dbMap.CreateTablesIfNotExists())
+	return dbMap
+}
+
+func TestGorpProjectConfigStore_Suite(t *testing.T) {
+	store := NewGorpProjectConfigStore(newTestGorpDbMap(t))
+	runProjectConfigStoreSuite(t, store)
+}
+
+func TestEtcdProjectConfigStore_Suite(t *testing.T) {
+	cluster := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	defer cluster.Terminate(t)
+
+	store, err := NewEtcdProjectConfigStore(cluster.RandClient(), "test-project", 0)
+	require.NoError(t, err)
+	runProjectConfigStoreSuite(t, store)
+}
+
+// TestEtcdProjectConfigStore_Watch checks the one behavior GorpProjectConfigStore
+// can't share: EtcdProjectConfigStore.Watch streaming a Put, then stopping
+// cleanly once its context is canceled.
+func TestEtcdProjectConfigStore_Watch(t *testing.T) {
+	cluster := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	defer cluster.Terminate(t)
+
+	store, err := NewEtcdProjectConfigStore(cluster.RandClient(), "test-project", 0)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := store.Watch(ctx, ProjectConfigOAuth)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put(&ProjectConfig{Type: ProjectConfigOAuth, Key: "k1", RawValue: []byte(`{}`)}))
+
+	select {
+	case ev := <-ch:
+		require.Equal(t, ProjectConfigPut, ev.EventType)
+		require.Equal(t, "k1", ev.Config.Key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for watch event")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		require.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for watch channel to close")
+	}
+}
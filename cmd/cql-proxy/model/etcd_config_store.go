@@ -0,0 +1,225 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/clientv3"
+)
+
+// EtcdProjectConfigStore is the etcd v3 backed ProjectConfigStore. Every
+// config is stored as a JSON value under
+// /covenantsql/projects/<projectID>/config/<type>/<key>, attached to a
+// single per-project lease so entries can be given a TTL without each Put
+// issuing its own lease grant.
+type EtcdProjectConfigStore struct {
+	client    *clientv3.Client
+	projectID string
+	leaseID   clientv3.LeaseID
+}
+
+// NewEtcdProjectConfigStore creates a store scoped to projectID. If ttl is
+// non-zero, a lease is granted up front and attached to every key this
+// store writes, so the whole project's config expires together; the store
+// never keeps the lease alive, so that happens ttl after this call. Pass 0
+// for config that should never expire on its own.
+func NewEtcdProjectConfigStore(client *clientv3.Client, projectID string, ttl time.Duration) (*EtcdProjectConfigStore, error) {
+	s := &EtcdProjectConfigStore{client: client, projectID: projectID}
+	if ttl > 0 {
+		lease, err := client.Grant(context.Background(), int64(ttl/time.Second))
+		if err != nil {
+			return nil, errors.Wrapf(err, "grant project config lease failed")
+		}
+		s.leaseID = lease.ID
+	}
+	return s, nil
+}
+
+func (s *EtcdProjectConfigStore) key(configType ProjectConfigType, key string) string {
+	return fmt.Sprintf("/covenantsql/projects/%s/config/%d/%s", s.projectID, configType, key)
+}
+
+func (s *EtcdProjectConfigStore) prefix(configType ProjectConfigType) string {
+	return fmt.Sprintf("/covenantsql/projects/%s/config/%d/", s.projectID, configType)
+}
+
+func (s *EtcdProjectConfigStore) decode(etcdKey string, value []byte) (*ProjectConfig, error) {
+	p := &ProjectConfig{RawValue: value}
+
+	// the last path segment is the config key; the one before it is the
+	// numeric ProjectConfigType.
+	parts := strings.Split(strings.TrimPrefix(etcdKey, fmt.Sprintf("/covenantsql/projects/%s/config/", s.projectID)), "/")
+	if len(parts) != 2 {
+		return nil, errors.Errorf("malformed project config key %q", etcdKey)
+	}
+	typ, err := strconv.ParseInt(parts[0], 10, 16)
+	if err != nil {
+		return nil, errors.Wrapf(err, "malformed project config key %q", etcdKey)
+	}
+	p.Type = ProjectConfigType(typ)
+	p.Key = parts[1]
+
+	decodeConfigValue(p)
+	return p, nil
+}
+
+// Get implements ProjectConfigStore.
+func (s *EtcdProjectConfigStore) Get(configType ProjectConfigType, key string) (*ProjectConfig, error) {
+	resp, err := s.client.Get(context.Background(), s.key(configType, key))
+	if err != nil {
+		return nil, errors.Wrapf(err, "get project config failed")
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrProjectConfigNotFound
+	}
+	return s.decode(string(resp.Kvs[0].Key), resp.Kvs[0].Value)
+}
+
+// List implements ProjectConfigStore.
+func (s *EtcdProjectConfigStore) List(configType ProjectConfigType) (configs []*ProjectConfig, err error) {
+	resp, err := s.client.Get(context.Background(), s.prefix(configType), clientv3.WithPrefix())
+	if err != nil {
+		err = errors.Wrapf(err, "list project config failed")
+		return
+	}
+	for _, kv := range resp.Kvs {
+		var p *ProjectConfig
+		if p, err = s.decode(string(kv.Key), kv.Value); err != nil {
+			return
+		}
+		configs = append(configs, p)
+	}
+	return
+}
+
+// Put implements ProjectConfigStore, unconditionally overwriting whatever
+// was stored under (p.Type, p.Key).
+func (s *EtcdProjectConfigStore) Put(p *ProjectConfig) error {
+	value, err := json.Marshal(p.Value)
+	if err != nil {
+		return errors.Wrapf(err, "encode project config data failed")
+	}
+
+	opts := []clientv3.OpOption{}
+	if s.leaseID != 0 {
+		opts = append(opts, clientv3.WithLease(s.leaseID))
+	}
+
+	_, err = s.client.Put(context.Background(), s.key(p.Type, p.Key), string(value), opts...)
+	if err != nil {
+		err = errors.Wrapf(err, "put project config failed")
+	}
+	return err
+}
+
+// Add implements UniqueAdder using If(CreateRevision==0) so two concurrent
+// Add calls for the same (Type, Key) can't both succeed.
+func (s *EtcdProjectConfigStore) Add(p *ProjectConfig) error {
+	value, err := json.Marshal(p.Value)
+	if err != nil {
+		return errors.Wrapf(err, "encode project config data failed")
+	}
+
+	opts := []clientv3.OpOption{}
+	if s.leaseID != 0 {
+		opts = append(opts, clientv3.WithLease(s.leaseID))
+	}
+
+	k := s.key(p.Type, p.Key)
+	resp, err := s.client.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.CreateRevision(k), "=", 0)).
+		Then(clientv3.OpPut(k, string(value), opts...)).
+		Commit()
+	if err != nil {
+		return errors.Wrapf(err, "add project config failed")
+	}
+	if !resp.Succeeded {
+		return ErrProjectConfigExists
+	}
+	return nil
+}
+
+// Delete implements ProjectConfigStore.
+func (s *EtcdProjectConfigStore) Delete(configType ProjectConfigType, key string) error {
+	_, err := s.client.Delete(context.Background(), s.key(configType, key))
+	if err != nil {
+		err = errors.Wrapf(err, "delete project config failed")
+	}
+	return err
+}
+
+// Watch implements ProjectConfigStore, streaming every subsequent change
+// under this project's configType prefix. Consumers such as the OAuth,
+// table and group config readers can use this to react to live config
+// changes instead of polling List on a timer.
+//
+// The forwarding goroutine and the underlying etcd watch both run for as
+// long as ctx is alive -- cancel ctx once the returned channel is no longer
+// being read so this doesn't leak. Without a caller-owned ctx, a forwarding
+// goroutine blocked on an unbuffered send into a channel nobody reads
+// anymore has no way to unwind, and neither does the etcd watch stream it
+// is draining.
+func (s *EtcdProjectConfigStore) Watch(ctx context.Context, configType ProjectConfigType) (<-chan ProjectConfigEvent, error) {
+	ch := make(chan ProjectConfigEvent)
+	watchCh := s.client.Watch(ctx, s.prefix(configType), clientv3.WithPrefix())
+
+	go func() {
+		defer close(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case resp, ok := <-watchCh:
+				if !ok {
+					return
+				}
+				for _, ev := range resp.Events {
+					var (
+						p   *ProjectConfig
+						err error
+					)
+					if ev.Type == clientv3.EventTypeDelete {
+						p, err = s.decode(string(ev.Kv.Key), nil)
+						if err != nil {
+							continue
+						}
+					} else if p, err = s.decode(string(ev.Kv.Key), ev.Kv.Value); err != nil {
+						continue
+					}
+					evType := ProjectConfigPut
+					if ev.Type == clientv3.EventTypeDelete {
+						evType = ProjectConfigDeleted
+					}
+					select {
+					case ch <- ProjectConfigEvent{EventType: evType, Config: p}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
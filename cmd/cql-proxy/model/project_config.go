@@ -145,9 +145,8 @@ func GetAllProjectConfig(db *gorp.DbMap) (p []*ProjectConfig, err error) {
 }
 
 // GetProjectOAuthConfig returns specified oauth provide config of project.
-func GetProjectOAuthConfig(db *gorp.DbMap, provider string) (p *ProjectConfig, pc *ProjectOAuthConfig, err error) {
-	err = db.SelectOne(&p, `SELECT * FROM "____config" WHERE "type" = ? AND "key" = ? LIMIT 1`,
-		ProjectConfigOAuth, provider)
+func GetProjectOAuthConfig(store ProjectConfigStore, provider string) (p *ProjectConfig, pc *ProjectOAuthConfig, err error) {
+	p, err = store.Get(ProjectConfigOAuth, provider)
 	if err != nil {
 		err = errors.Wrapf(err, "get project oauth config failed")
 		return
@@ -164,9 +163,8 @@ func GetProjectOAuthConfig(db *gorp.DbMap, provider string) (p *ProjectConfig, p
 }
 
 // GetProjectTableConfig returns specified table config of project.
-func GetProjectTableConfig(db *gorp.DbMap, tableName string) (p *ProjectConfig, pc *ProjectTableConfig, err error) {
-	err = db.SelectOne(&p, `SELECT * FROM "____config" WHERE "type" = ? AND "key" = ? LIMIT 1`,
-		ProjectConfigTable, tableName)
+func GetProjectTableConfig(store ProjectConfigStore, tableName string) (p *ProjectConfig, pc *ProjectTableConfig, err error) {
+	p, err = store.Get(ProjectConfigTable, tableName)
 	if err != nil {
 		err = errors.Wrapf(err, "get project table config failed")
 		return
@@ -183,10 +181,8 @@ func GetProjectTableConfig(db *gorp.DbMap, tableName string) (p *ProjectConfig,
 }
 
 // GetProjectTablesName returns all table names of project.
-func GetProjectTablesName(db *gorp.DbMap) (tables []string, err error) {
-	var projects []*ProjectConfig
-
-	_, err = db.Select(&projects, `SELECT * FROM "____config" WHERE "type" = ?`, ProjectConfigTable)
+func GetProjectTablesName(store ProjectConfigStore) (tables []string, err error) {
+	projects, err := store.List(ProjectConfigTable)
 	if err != nil {
 		err = errors.Wrapf(err, "get project table config failed")
 		return
@@ -206,13 +202,17 @@ func GetProjectTablesName(db *gorp.DbMap) (tables []string, err error) {
 }
 
 // GetProjectMiscConfig returns misc config object of project.
-func GetProjectMiscConfig(db *gorp.DbMap) (p *ProjectConfig, pc *ProjectMiscConfig, err error) {
-	err = db.SelectOne(&p, `SELECT * FROM "____config" WHERE "type" = ? LIMIT 1`,
-		ProjectConfigMisc)
+func GetProjectMiscConfig(store ProjectConfigStore) (p *ProjectConfig, pc *ProjectMiscConfig, err error) {
+	configs, err := store.List(ProjectConfigMisc)
 	if err != nil {
 		err = errors.Wrapf(err, "get project misc config failed")
 		return
 	}
+	if len(configs) == 0 {
+		err = ErrProjectConfigNotFound
+		return
+	}
+	p = configs[0]
 
 	err = json.Unmarshal(p.RawValue, &pc)
 	if err == nil {
@@ -225,13 +225,17 @@ func GetProjectMiscConfig(db *gorp.DbMap) (p *ProjectConfig, pc *ProjectMiscConf
 }
 
 // GetProjectGroupConfig returns group config object of project.
-func GetProjectGroupConfig(db *gorp.DbMap) (p *ProjectConfig, gc *ProjectGroupConfig, err error) {
-	err = db.SelectOne(&p, `SELECT * FROM "____config" WHERE "type" = ? LIMIT 1`,
-		ProjectConfigGroup)
+func GetProjectGroupConfig(store ProjectConfigStore) (p *ProjectConfig, gc *ProjectGroupConfig, err error) {
+	configs, err := store.List(ProjectConfigGroup)
 	if err != nil {
 		err = errors.Wrapf(err, "get project group config failed")
 		return
 	}
+	if len(configs) == 0 {
+		err = ErrProjectConfigNotFound
+		return
+	}
+	p = configs[0]
 
 	err = json.Unmarshal(p.RawValue, &gc)
 	if err != nil {
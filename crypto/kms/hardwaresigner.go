@@ -0,0 +1,147 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+// WIP: apduFrame and fetchPubKey below talk a placeholder APDU protocol --
+// the CLA/INS/P1/P2 bytes are NOT a real vendor's documented sign/get-pubkey
+// instruction set (see their own TODO(auxten) comments). HardwareSigner
+// compiles and satisfies Signer, but it cannot talk to an actual Ledger/
+// Trezor-style device yet; wiring in the real protocol is still open work,
+// not something this file finishes.
+
+import (
+	"errors"
+
+	ec "github.com/btcsuite/btcd/btcec"
+	"github.com/karalabe/hid"
+)
+
+// ErrHardwareSignerClosed is returned by HardwareSigner methods once Close
+// has been called.
+var ErrHardwareSignerClosed = errors.New("kms: hardware signer closed")
+
+// hardwareVendorID/hardwareProductID identify the USB HID device this
+// signer talks to. They default to the Ledger Nano S vendor/product pair;
+// callers targeting a different device pass their own ids to
+// OpenHardwareSigner.
+const (
+	hardwareVendorID  = 0x2c97
+	hardwareProductID = 0x0001
+)
+
+// apduFrame wraps digest into the APDU command byte layout Ledger/Trezor
+// style devices expect for a sign request at bip32Path. The instruction
+// class/codes here are placeholders: a real integration fills in the
+// vendor's documented CLA/INS/P1/P2 for "sign digest at derivation path".
+func apduFrame(bip32Path string, digest []byte) []byte {
+	// TODO(auxten): encode bip32Path as the 4-byte-per-level derivation
+	// path the device firmware expects, and use the vendor's real
+	// CLA/INS/P1/P2 sign-digest instruction instead of these placeholders.
+	const cla, ins, p1, p2 = 0x80, 0x02, 0x00, 0x00
+	frame := []byte{cla, ins, p1, p2, byte(len(digest))}
+	return append(frame, digest...)
+}
+
+// HardwareSigner is a Signer backed by a USB HID hardware wallet (Ledger/
+// Trezor-style APDU transport): the private scalar never leaves the
+// device, only the compressed public key (fetched once, up front) and
+// 32-byte message digests cross the wire.
+type HardwareSigner struct {
+	device    *hid.Device
+	bip32Path string
+	pub       *ec.PublicKey
+	closed    bool
+}
+
+// OpenHardwareSigner opens the first USB HID device matching vendorID/
+// productID, derives the public key at bip32Path and returns a ready to
+// use Signer. Pass 0 for vendorID/productID to use the default Ledger
+// vendor/product pair.
+func OpenHardwareSigner(vendorID, productID uint16, bip32Path string) (*HardwareSigner, error) {
+	if vendorID == 0 {
+		vendorID = hardwareVendorID
+	}
+	if productID == 0 {
+		productID = hardwareProductID
+	}
+
+	infos, err := hid.Enumerate(vendorID, productID)
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, errors.New("kms: no matching hardware wallet found")
+	}
+
+	device, err := infos[0].Open()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &HardwareSigner{device: device, bip32Path: bip32Path}
+	if s.pub, err = s.fetchPubKey(); err != nil {
+		_ = device.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *HardwareSigner) fetchPubKey() (*ec.PublicKey, error) {
+	// TODO(auxten): issue the vendor's "get public key at derivation path"
+	// APDU and parse the compressed secp256k1 point out of the response,
+	// instead of returning the request's error unexpanded.
+	const cla, ins, p1, p2 = 0x80, 0x04, 0x00, 0x00
+	_, err := s.device.Write([]byte{cla, ins, p1, p2})
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65)
+	if _, err = s.device.Read(buf); err != nil {
+		return nil, err
+	}
+	return ec.ParsePubKey(buf[:33], ec.S256())
+}
+
+// PubKey implements Signer.
+func (s *HardwareSigner) PubKey() *ec.PublicKey { return s.pub }
+
+// Sign implements Signer by forwarding digest to the device for signing at
+// the derivation path given to OpenHardwareSigner, and returns the
+// DER-encoded secp256k1 signature the device replies with.
+func (s *HardwareSigner) Sign(digest []byte) ([]byte, error) {
+	if s.closed {
+		return nil, ErrHardwareSignerClosed
+	}
+	if _, err := s.device.Write(apduFrame(s.bip32Path, digest)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 72)
+	n, err := s.device.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Close implements Signer, releasing the HID handle.
+func (s *HardwareSigner) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.device.Close()
+}
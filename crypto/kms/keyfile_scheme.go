@@ -0,0 +1,155 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// keyFileVersionScheme is the version byte SavePrivateKeyScheme writes: the
+// byte right after it is the Scheme's ID, so the file self-describes which
+// curve/algorithm it holds instead of the reader having to assume
+// secp256k1 (the assumption keyFileVersionXChaCha20Poly1305 still makes).
+const keyFileVersionScheme = 2
+
+// ErrUnsupportedSignerForPersist is returned by InitLocalKeyPairWithScheme
+// when scheme.GenPriv() returns a Signer that cannot hand back its raw key
+// material (e.g. a future HardwareSigner-backed Scheme) -- there is
+// nothing to write to keyFilePath in that case, the device itself is the
+// persistence.
+var ErrUnsupportedSignerForPersist = errors.New("kms: scheme's signer does not support persisting raw key material")
+
+// SavePrivateKeyScheme writes raw (a scheme.PrivKeyLen()-byte private
+// scalar/seed) to keyFilePath tagged with scheme's ID, encrypted the same
+// way SavePrivateKeyV1 is (Argon2id-derived XChaCha20-Poly1305 key).
+func SavePrivateKeyScheme(keyFilePath string, scheme Scheme, raw []byte, masterKey []byte, params KDFParams) (err error) {
+	if len(raw) != scheme.PrivKeyLen() {
+		return errors.New("kms: raw key length does not match scheme.PrivKeyLen()")
+	}
+	if params == (KDFParams{}) {
+		params = DefaultKDFParams
+	}
+
+	salt := make([]byte, keyFileV1SaltLen)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+	nonce := make([]byte, keyFileV1NonceLen)
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+
+	aead, err := chacha20poly1305.NewX(params.deriveKey(masterKey, salt))
+	if err != nil {
+		return
+	}
+	ciphertext := aead.Seal(nil, nonce, raw, nil)
+
+	out := make([]byte, 0, 2+len(salt)+len(nonce)+len(ciphertext))
+	out = append(out, keyFileVersionScheme, scheme.ID())
+	out = append(out, salt...)
+	out = append(out, nonce...)
+	out = append(out, ciphertext...)
+
+	return ioutil.WriteFile(keyFilePath, out, 0600)
+}
+
+// LoadPrivateKeyScheme reads a key file written by SavePrivateKeyScheme and
+// returns the Scheme it was tagged with and the decrypted raw private
+// key/seed -- the caller turns that into a Signer via scheme.ParsePriv.
+func LoadPrivateKeyScheme(keyFilePath string, masterKey []byte, params KDFParams) (scheme Scheme, raw []byte, err error) {
+	fileContent, err := ioutil.ReadFile(keyFilePath)
+	if err != nil {
+		return
+	}
+
+	minLen := 2 + keyFileV1SaltLen + keyFileV1NonceLen
+	if len(fileContent) < minLen || fileContent[0] != keyFileVersionScheme {
+		return nil, nil, errors.New("kms: not a scheme-tagged key file")
+	}
+	if params == (KDFParams{}) {
+		params = DefaultKDFParams
+	}
+
+	scheme, err = SchemeByID(fileContent[1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rest := fileContent[2:]
+	salt := rest[:keyFileV1SaltLen]
+	rest = rest[keyFileV1SaltLen:]
+	nonce := rest[:keyFileV1NonceLen]
+	ciphertext := rest[keyFileV1NonceLen:]
+
+	aead, err := chacha20poly1305.NewX(params.deriveKey(masterKey, salt))
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err = aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return scheme, raw, nil
+}
+
+// InitLocalKeyPairWithScheme is the Scheme-aware counterpart of
+// InitLocalKeyPair: if privateKeyPath already holds a scheme-tagged file it
+// is loaded and parsed via the tagged Scheme (which need not be the same
+// as the scheme argument); otherwise a fresh key is generated under scheme
+// and persisted. Either way the result is installed via
+// SetLocalSchemeSigner.
+func InitLocalKeyPairWithScheme(privateKeyPath string, scheme Scheme, masterKey []byte, params KDFParams) (err error) {
+	InitLocalKeyStore()
+
+	_, statErr := os.Stat(privateKeyPath)
+	if statErr != nil && !keyFileNotExist(statErr) {
+		return statErr
+	}
+	if statErr == nil {
+		var loadedScheme Scheme
+		var raw []byte
+		if loadedScheme, raw, err = LoadPrivateKeyScheme(privateKeyPath, masterKey, params); err != nil {
+			return
+		}
+		var signer Signer
+		if signer, err = loadedScheme.ParsePriv(raw); err != nil {
+			return
+		}
+		SetLocalSchemeSigner(loadedScheme, signer)
+		return nil
+	}
+
+	signer, err := scheme.GenPriv()
+	if err != nil {
+		return
+	}
+	rk, ok := signer.(rawKeyer)
+	if !ok {
+		return ErrUnsupportedSignerForPersist
+	}
+	if err = SavePrivateKeyScheme(privateKeyPath, scheme, rk.rawKey(), masterKey, params); err != nil {
+		return
+	}
+	SetLocalSchemeSigner(scheme, signer)
+	return nil
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	ec "github.com/btcsuite/btcd/btcec"
+	log "github.com/sirupsen/logrus"
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+	"github.com/thunderdb/ThunderDB/crypto/symmetric"
+	"golang.org/x/crypto/openpgp"
+)
+
+// dataKeyLen is the size, in bytes, of the random key used to symmetrically
+// encrypt the private key blob before it is escrowed to PGP recipients.
+const dataKeyLen = 32
+
+var (
+	// ErrNoPGPRecipients is returned by ExportPrivateKeyPGP when called
+	// without at least one recipient public key.
+	ErrNoPGPRecipients = errors.New("pgp: no recipients given")
+	// ErrMalformedPGPFile is returned by ImportPrivateKeyPGP when the
+	// escrow file does not contain a wrapped-data-key section.
+	ErrMalformedPGPFile = errors.New("pgp: malformed escrow file")
+)
+
+// ExportPrivateKeyPGP hands off the private key stored (encrypted under
+// masterKey) at keyFilePath to one or more PGP recipients, without ever
+// exposing cleartext on disk: it generates a random data key, re-encrypts
+// "sha256(priv)||priv" under that data key with the same symmetric AEAD
+// SavePrivateKey already uses, wraps the data key with openpgp to
+// pgpPubKeys (each an ASCII-armored public key), and writes the wrapped
+// data-key packet followed by the ciphertext to outFilePath.
+func ExportPrivateKeyPGP(keyFilePath string, masterKey []byte, pgpPubKeys [][]byte, outFilePath string) (err error) {
+	if len(pgpPubKeys) == 0 {
+		return ErrNoPGPRecipients
+	}
+
+	key, err := LoadPrivateKey(keyFilePath, masterKey)
+	if err != nil {
+		log.Errorf("load private key for pgp export failed: %s", err)
+		return
+	}
+
+	serializedKey := key.Serialize()
+	keyHash := hash.DoubleHashB(serializedKey)
+	rawData := append(keyHash, serializedKey...)
+
+	dataKey := make([]byte, dataKeyLen)
+	if _, err = rand.Read(dataKey); err != nil {
+		return
+	}
+
+	ciphertext, err := symmetric.EncryptWithPassword(rawData, dataKey)
+	if err != nil {
+		return
+	}
+
+	var recipients openpgp.EntityList
+	for _, pub := range pgpPubKeys {
+		var ring openpgp.EntityList
+		if ring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(pub)); err != nil {
+			log.Errorf("parse pgp recipient key failed: %s", err)
+			return
+		}
+		recipients = append(recipients, ring...)
+	}
+
+	var wrapped bytes.Buffer
+	w, err := openpgp.Encrypt(&wrapped, recipients, nil, nil, nil)
+	if err != nil {
+		return
+	}
+	if _, err = w.Write(dataKey); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+
+	var out bytes.Buffer
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(wrapped.Len()))
+	out.Write(lenBuf[:])
+	out.Write(wrapped.Bytes())
+	out.Write(ciphertext)
+
+	return ioutil.WriteFile(outFilePath, out.Bytes(), 0600)
+}
+
+// ImportPrivateKeyPGP recovers a private key previously written by
+// ExportPrivateKeyPGP: it decrypts the wrapped data-key packet using a
+// local PGP private keyring (unlocked with passphrase), then feeds the
+// recovered data key through the same decrypt/verify path LoadPrivateKey
+// uses for the symmetric AEAD ciphertext.
+func ImportPrivateKeyPGP(pgpFilePath string, privateKeyring []byte, passphrase []byte) (key *ec.PrivateKey, err error) {
+	fileContent, err := ioutil.ReadFile(pgpFilePath)
+	if err != nil {
+		log.Errorf("error read pgp escrow file: %s, err: %s", pgpFilePath, err)
+		return
+	}
+
+	if len(fileContent) < 4 {
+		return nil, ErrMalformedPGPFile
+	}
+	wrappedLen := binary.BigEndian.Uint32(fileContent[:4])
+	if uint32(len(fileContent)-4) < wrappedLen {
+		return nil, ErrMalformedPGPFile
+	}
+	wrapped := fileContent[4 : 4+wrappedLen]
+	ciphertext := fileContent[4+wrappedLen:]
+
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(privateKeyring))
+	if err != nil {
+		log.Errorf("parse pgp private keyring failed: %s", err)
+		return
+	}
+
+	promptFunc := func(keys []openpgp.Key, isSymmetric bool) ([]byte, error) {
+		for _, k := range keys {
+			if k.PrivateKey == nil || !k.PrivateKey.Encrypted {
+				continue
+			}
+			if err := k.PrivateKey.Decrypt(passphrase); err != nil {
+				continue
+			}
+		}
+		return nil, nil
+	}
+
+	md, err := openpgp.ReadMessage(bytes.NewReader(wrapped), keyring, promptFunc, nil)
+	if err != nil {
+		log.Errorf("decrypt pgp wrapped data key failed: %s", err)
+		return
+	}
+
+	dataKey, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return
+	}
+
+	decData, err := symmetric.DecryptWithPassword(ciphertext, dataKey)
+	if err != nil {
+		log.Errorf("decrypt private key error")
+		return
+	}
+
+	if len(decData) != hash.HashBSize+ec.PrivKeyBytesLen {
+		log.Errorf("private key file size should be %d bytes",
+			hash.HashBSize+ec.PrivKeyBytesLen)
+		return nil, ErrNotKeyFile
+	}
+
+	computedHash := hash.DoubleHashB(decData[hash.HashBSize:])
+	if subtle.ConstantTimeCompare(computedHash, decData[:hash.HashBSize]) != 1 {
+		return nil, ErrHashNotMatch
+	}
+
+	key, _ = ec.PrivKeyFromBytes(ec.S256(), decData[hash.HashBSize:])
+	return
+}
+
+// InitLocalKeyPairWithPGP behaves exactly like InitLocalKeyPair, except
+// that when no private key file exists yet and a new one is generated, it
+// is simultaneously escrowed (ExportPrivateKeyPGP) to pgpRecipients at
+// keyFilePath+".pgp" -- mirroring the pgp_key escrow pattern used for cloud
+// service-account key provisioning, so an operator never has to handle the
+// cleartext key to hand it off to another node.
+func InitLocalKeyPairWithPGP(privateKeyPath string, masterKey []byte, pgpRecipients [][]byte) (err error) {
+	_, statErr := os.Stat(privateKeyPath)
+	generated := keyFileNotExist(statErr)
+	if err = InitLocalKeyPair(privateKeyPath, masterKey); err != nil {
+		return
+	}
+	if !generated || len(pgpRecipients) == 0 {
+		return
+	}
+	return ExportPrivateKeyPGP(privateKeyPath, masterKey, pgpRecipients, privateKeyPath+".pgp")
+}
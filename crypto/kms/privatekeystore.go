@@ -17,7 +17,7 @@
 package kms
 
 import (
-	"bytes"
+	"crypto/subtle"
 	"errors"
 	"io/ioutil"
 	"os"
@@ -37,7 +37,13 @@ var (
 )
 
 // LoadPrivateKey loads private key from keyFilePath, and verifies the hash
-// head
+// head. It tries loadPrivateKeyV1 (Argon2id + XChaCha20-Poly1305) first,
+// falling back to the legacy v0 format (no version byte,
+// symmetric.EncryptWithPassword over sha256(priv)||priv) whenever
+// loadPrivateKeyV1 doesn't report a successful decryption -- not just when
+// the file looks wrong, but also when it merely happens to start with the
+// v1 version byte without actually being one, so keys written before the v1
+// format existed keep loading unchanged.
 func LoadPrivateKey(keyFilePath string, masterKey []byte) (key *ec.PrivateKey, err error) {
 	fileContent, err := ioutil.ReadFile(keyFilePath)
 	if err != nil {
@@ -45,6 +51,10 @@ func LoadPrivateKey(keyFilePath string, masterKey []byte) (key *ec.PrivateKey, e
 		return
 	}
 
+	if key, ok, _ := loadPrivateKeyV1(fileContent, masterKey, DefaultKDFParams); ok {
+		return key, nil
+	}
+
 	decData, err := symmetric.DecryptWithPassword(fileContent, masterKey)
 	if err != nil {
 		log.Errorf("decrypt private key error")
@@ -59,7 +69,7 @@ func LoadPrivateKey(keyFilePath string, masterKey []byte) (key *ec.PrivateKey, e
 	}
 
 	computedHash := hash.DoubleHashB(decData[hash.HashBSize:])
-	if bytes.Compare(computedHash, decData[:hash.HashBSize]) != 0 {
+	if subtle.ConstantTimeCompare(computedHash, decData[:hash.HashBSize]) != 1 {
 		return nil, ErrHashNotMatch
 	}
 
@@ -85,7 +95,28 @@ func GeneratePrivateKey() (key *ec.PrivateKey, err error) {
 	return ec.NewPrivateKey(ec.S256())
 }
 
-// InitLocalKeyPair initializes local private key
+// keyFileNotExist reports whether err, as returned by LoadPrivateKey,
+// LoadPrivateKeyScheme or os.Stat, means "no key file at this path yet" as
+// opposed to a decrypt failure. Any *os.PathError counts as "no key file",
+// not only a missing file (a permission error does too) -- every
+// InitLocalKeyPair variant
+// backed by a key file treats that distinction the same way, so it lives in
+// one place instead of being reimplemented per variant.
+func keyFileNotExist(err error) bool {
+	if err == nil {
+		return false
+	}
+	if os.IsNotExist(err) {
+		return true
+	}
+	_, ok := err.(*os.PathError)
+	return ok
+}
+
+// InitLocalKeyPair initializes local private key, loading privateKeyPath if
+// it exists (LoadPrivateKey handles both the legacy and v1 on-disk formats
+// transparently) or generating and saving a new one in the versioned v1
+// format (SavePrivateKeyV1) if it doesn't.
 func InitLocalKeyPair(privateKeyPath string, masterKey []byte) (err error) {
 	var privateKey *ec.PrivateKey
 	var publicKey *ec.PublicKey
@@ -96,7 +127,7 @@ func InitLocalKeyPair(privateKeyPath string, masterKey []byte) (err error) {
 			log.Errorf("not a valid private key file: %s", privateKeyPath)
 			return
 		}
-		if _, ok := err.(*os.PathError); ok || err == os.ErrNotExist {
+		if keyFileNotExist(err) {
 			log.Info("private key file not exist, generating one")
 			// TODO(auxten): generate public key and use cpu miner to
 			// 	generate a nonce to match the difficulty at idminer
@@ -106,7 +137,7 @@ func InitLocalKeyPair(privateKeyPath string, masterKey []byte) (err error) {
 				return
 			}
 			log.Infof("saving new private key file: %s", privateKeyPath)
-			err = SavePrivateKey(privateKeyPath, privateKey, masterKey)
+			err = SavePrivateKeyV1(privateKeyPath, privateKey, masterKey, DefaultKDFParams)
 			if err != nil {
 				log.Errorf("save private key failed: %s", err)
 				return
@@ -121,5 +152,58 @@ func InitLocalKeyPair(privateKeyPath string, masterKey []byte) (err error) {
 	}
 	log.Infof("\n### Public Key ###\n%x\n### Public Key ###\n", publicKey.SerializeCompressed())
 	SetLocalKeyPair(privateKey, publicKey)
+	if scheme, schemeErr := SchemeByID(SchemeSecp256k1ID); schemeErr == nil {
+		SetLocalSchemeSigner(scheme, NewSoftwareSigner(privateKey))
+	}
+	return
+}
+
+// InitLocalKeyPairWithShares behaves exactly like InitLocalKeyPair, except
+// the operator never has to hand a single long-lived master key to the
+// process: it reconstructs the master key from k-of-n Shamir shares
+// (CombineMasterKey) -- typically one brought in by each of several
+// custodians -- uses it for the one LoadPrivateKey/SavePrivateKeyV1 call,
+// then zeroes it, so at most one InitLocalKeyPair call's worth of key
+// material is ever resident in memory.
+func InitLocalKeyPairWithShares(privateKeyPath string, shares [][]byte) (err error) {
+	masterKey, err := CombineMasterKey(shares)
+	if err != nil {
+		return
+	}
+	defer zeroBytes(masterKey)
+
+	return InitLocalKeyPair(privateKeyPath, masterKey)
+}
+
+// zeroBytes overwrites b with zeroes in place.
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// InitLocalKeyPairWithHardware behaves like InitLocalKeyPair, except the
+// local keypair is backed by a USB HID hardware wallet instead of a key
+// file: it never calls GenSecp256k1KeyPair/SavePrivateKey, it opens the
+// device, derives the public key at bip32Path, and registers a
+// HardwareSigner (SetLocalSigner) as the local keypair's signer. Pass 0 for
+// vendorID/productID to use the default Ledger vendor/product pair.
+//
+// A hardware-backed signer has no private scalar to hand out through
+// GetLocalPrivateKey -- the scalar never leaves the device -- so a signing
+// site has to go through kms.GetLocalSigner().Sign to work under both
+// InitLocalKeyPair and InitLocalKeyPairWithHardware. InitLocalKeyPair
+// installs a software Signer alongside the bare keypair it has always set
+// for exactly this reason: so GetLocalSigner() is never nil regardless of
+// which Init* call brought the local key up.
+func InitLocalKeyPairWithHardware(vendorID, productID uint16, bip32Path string) (err error) {
+	InitLocalKeyStore()
+	signer, err := OpenHardwareSigner(vendorID, productID, bip32Path)
+	if err != nil {
+		log.Errorf("open hardware wallet failed: %s", err)
+		return
+	}
+	log.Infof("\n### Public Key ###\n%x\n### Public Key ###\n", signer.PubKey().SerializeCompressed())
+	SetLocalSigner(signer)
 	return
-}
\ No newline at end of file
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+
+	ec "github.com/btcsuite/btcd/btcec"
+)
+
+// Note on types.TokenReceive: callers building or verifying a TokenReceive
+// signed by a local Signer should hash it with
+// types.MarshalHashWithScheme(t, scheme.ID()), not t.MarshalHash(), so the
+// hash captures which Scheme produced Signature.
+
+// Scheme is a pluggable signature algorithm KMS can hold a local key under.
+// Parsing/generating a key is routed through the Scheme so the keystore
+// itself never has to hard-code secp256k1-specific constants like
+// ec.PrivKeyBytesLen/ec.S256() -- registering a new Scheme is enough to let
+// KMS hold that kind of key.
+type Scheme interface {
+	// ID is the 1-byte tag a scheme-aware key file prepends to its
+	// encrypted payload, so a loader can tell which Scheme parses it.
+	ID() uint8
+	// PrivKeyLen is the exact byte length ParsePriv expects.
+	PrivKeyLen() int
+	// ParsePriv builds a Signer from a raw private scalar/seed of
+	// PrivKeyLen bytes.
+	ParsePriv(raw []byte) (Signer, error)
+	// GenPriv generates a fresh Signer under this scheme.
+	GenPriv() (Signer, error)
+}
+
+var schemes = make(map[uint8]Scheme)
+
+// RegisterScheme adds s to the registry LoadPrivateKeyScheme/SchemeByID
+// consult. Intended to be called from package init funcs; panics on a
+// duplicate ID since that indicates two schemes were compiled in by
+// mistake.
+func RegisterScheme(s Scheme) {
+	if _, exists := schemes[s.ID()]; exists {
+		panic("kms: duplicate scheme id")
+	}
+	schemes[s.ID()] = s
+}
+
+// ErrUnknownScheme is returned by SchemeByID when id has no registered
+// Scheme.
+var ErrUnknownScheme = errors.New("kms: unknown scheme id")
+
+// SchemeByID looks up a previously registered Scheme.
+func SchemeByID(id uint8) (Scheme, error) {
+	s, ok := schemes[id]
+	if !ok {
+		return nil, ErrUnknownScheme
+	}
+	return s, nil
+}
+
+// SchemeSecp256k1ID/SchemeEd25519ID are the well-known scheme tags for the
+// two Scheme implementations this package registers by default.
+const (
+	SchemeSecp256k1ID uint8 = 0
+	SchemeEd25519ID   uint8 = 1
+)
+
+// secp256k1Scheme wraps the existing ec.PrivateKey-based behavior as a
+// Scheme, so it can sit in the registry alongside ed25519Scheme without
+// changing what a secp256k1 account key actually is.
+type secp256k1Scheme struct{}
+
+func (secp256k1Scheme) ID() uint8       { return SchemeSecp256k1ID }
+func (secp256k1Scheme) PrivKeyLen() int { return ec.PrivKeyBytesLen }
+
+func (secp256k1Scheme) ParsePriv(raw []byte) (Signer, error) {
+	priv, _ := ec.PrivKeyFromBytes(ec.S256(), raw)
+	return NewSoftwareSigner(priv), nil
+}
+
+func (secp256k1Scheme) GenPriv() (Signer, error) {
+	priv, err := ec.NewPrivateKey(ec.S256())
+	if err != nil {
+		return nil, err
+	}
+	return NewSoftwareSigner(priv), nil
+}
+
+// ed25519Signer adapts a crypto/ed25519 key pair to Signer. Sign returns
+// the raw 64-byte ed25519 signature -- Signer.Sign's return type is
+// scheme-agnostic for exactly this reason, so ed25519Signer doesn't have
+// to force its signature into a secp256k1 encoding.
+type ed25519Signer struct {
+	priv ed25519.PrivateKey
+	pub  ed25519.PublicKey
+}
+
+// PubKey returns nil: ed25519 keys don't have a secp256k1 curve point to
+// hand back, and Signer.PubKey's doc comment permits exactly this for a
+// non-secp256k1 implementation rather than fabricating one. Callers that
+// need the raw ed25519 public key should type-assert the Signer to
+// *ed25519Signer and read PublicKeyBytes instead of calling PubKey.
+func (s *ed25519Signer) PubKey() *ec.PublicKey {
+	return nil
+}
+
+// PublicKeyBytes returns the raw 32-byte ed25519 public key.
+func (s *ed25519Signer) PublicKeyBytes() []byte {
+	return s.pub
+}
+
+func (s *ed25519Signer) Sign(digest []byte) ([]byte, error) {
+	return ed25519.Sign(s.priv, digest), nil
+}
+
+func (s *ed25519Signer) Close() error { return nil }
+
+func (s *ed25519Signer) rawKey() []byte { return s.priv.Seed() }
+
+type ed25519Scheme struct{}
+
+func (ed25519Scheme) ID() uint8       { return SchemeEd25519ID }
+func (ed25519Scheme) PrivKeyLen() int { return ed25519.SeedSize }
+
+func (ed25519Scheme) ParsePriv(raw []byte) (Signer, error) {
+	if len(raw) != ed25519.SeedSize {
+		return nil, errors.New("kms: wrong ed25519 seed length")
+	}
+	priv := ed25519.NewKeyFromSeed(raw)
+	return &ed25519Signer{priv: priv, pub: priv.Public().(ed25519.PublicKey)}, nil
+}
+
+func (ed25519Scheme) GenPriv() (Signer, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &ed25519Signer{priv: priv, pub: pub}, nil
+}
+
+func init() {
+	RegisterScheme(secp256k1Scheme{})
+	RegisterScheme(ed25519Scheme{})
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+var (
+	// ErrInvalidShamirParams is returned by SplitMasterKey when n/k are out
+	// of range (k must be at least 2, n must be at least k, and both must
+	// fit in a single byte x-coordinate).
+	ErrInvalidShamirParams = errors.New("shamir: invalid n/k")
+	// ErrTooFewShares is returned by CombineMasterKey when fewer than 2
+	// shares are given, or the given shares don't agree on a key length.
+	ErrTooFewShares = errors.New("shamir: too few shares, or mismatched share length")
+	// ErrDuplicateShare is returned by CombineMasterKey when two shares
+	// carry the same x-coordinate.
+	ErrDuplicateShare = errors.New("shamir: duplicate share x-coordinate")
+)
+
+// gf256Exp/gf256Log are the standard AES-polynomial (0x11b) exp/log tables
+// used to do GF(2^8) multiplication and division in constant-ish time.
+var gf256Exp [255]byte
+var gf256Log [256]byte
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gf256Exp[i] = x
+		gf256Log[x] = byte(i)
+
+		// advance x to the next power of the generator 0x03: x*3 = xtime(x)
+		// xor x, reducing modulo the AES polynomial 0x11b when xtime
+		// overflows.
+		xtime := x << 1
+		if x&0x80 != 0 {
+			xtime ^= 0x1b
+		}
+		x = xtime ^ x
+	}
+}
+
+func gf256Mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	sum := int(gf256Log[a]) + int(gf256Log[b])
+	if sum >= 255 {
+		sum -= 255
+	}
+	return gf256Exp[sum]
+}
+
+func gf256Div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	diff := int(gf256Log[a]) - int(gf256Log[b])
+	if diff < 0 {
+		diff += 255
+	}
+	return gf256Exp[diff]
+}
+
+// SplitMasterKey splits master into n Shamir shares over GF(2^8), any k of
+// which can reconstruct it via CombineMasterKey: one degree-(k-1)
+// polynomial is generated per byte of master (the byte itself is the
+// constant term), evaluated at x=1..n. Each returned share is
+// len(master)+1 bytes: a leading x-coordinate byte followed by the
+// evaluated bytes.
+func SplitMasterKey(master []byte, n, k int) ([][]byte, error) {
+	if k < 2 || n < k || n < 1 || n > 255 {
+		return nil, ErrInvalidShamirParams
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(master)+1)
+		shares[i][0] = byte(i + 1)
+	}
+
+	for byteIdx, secretByte := range master {
+		coeffs := make([]byte, k)
+		coeffs[0] = secretByte
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			x := share[0]
+			share[byteIdx+1] = evalPoly(coeffs, x)
+		}
+	}
+
+	return shares, nil
+}
+
+// evalPoly evaluates coeffs (coeffs[0] + coeffs[1]*x + ... ) at x over
+// GF(2^8) using Horner's method.
+func evalPoly(coeffs []byte, x byte) byte {
+	result := byte(0)
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		result = gf256Mul(result, x) ^ coeffs[i]
+	}
+	return result
+}
+
+// CombineMasterKey recovers the master key from k-of-n shares produced by
+// SplitMasterKey, via Lagrange interpolation at x=0. Shares may be given in
+// any order and any subset of at least 2 is accepted -- CombineMasterKey
+// does not know the original k, so callers are responsible for supplying
+// enough shares to actually recover the key (too few silently yields a
+// wrong result, same as any Shamir scheme).
+func CombineMasterKey(shares [][]byte) (master []byte, err error) {
+	if len(shares) < 2 {
+		return nil, ErrTooFewShares
+	}
+	keyLen := len(shares[0]) - 1
+	if keyLen < 1 {
+		return nil, ErrTooFewShares
+	}
+	xs := make([]byte, len(shares))
+	for i, s := range shares {
+		if len(s) != keyLen+1 {
+			return nil, ErrTooFewShares
+		}
+		xs[i] = s[0]
+		for j := 0; j < i; j++ {
+			if xs[j] == xs[i] {
+				return nil, ErrDuplicateShare
+			}
+		}
+	}
+
+	master = make([]byte, keyLen)
+	for byteIdx := range master {
+		master[byteIdx] = lagrangeAtZero(xs, shares, byteIdx)
+	}
+	return master, nil
+}
+
+// lagrangeAtZero evaluates the Lagrange interpolation polynomial through
+// (xs[i], shares[i][byteIdx+1]) at x=0.
+func lagrangeAtZero(xs []byte, shares [][]byte, byteIdx int) byte {
+	result := byte(0)
+	for i, xi := range xs {
+		yi := shares[i][byteIdx+1]
+		num := byte(1)
+		den := byte(1)
+		for j, xj := range xs {
+			if i == j {
+				continue
+			}
+			// term contributed by (0 - xj) / (xi - xj), and subtraction is
+			// XOR in GF(2^8)
+			num = gf256Mul(num, xj)
+			den = gf256Mul(den, xi^xj)
+		}
+		result ^= gf256Mul(yi, gf256Div(num, den))
+	}
+	return result
+}
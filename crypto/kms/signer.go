@@ -0,0 +1,134 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	ec "github.com/btcsuite/btcd/btcec"
+)
+
+// Signer is the capability SetLocalKeyPair/GetLocalPrivateKey consumers
+// should depend on instead of a bare *ec.PrivateKey, so the private scalar
+// never has to live in Go memory: a software key keeps it in a
+// softwareSigner, while HardwareSigner leaves it on a USB HID device for
+// the whole process lifetime.
+type Signer interface {
+	// PubKey returns the signer's public key. Implementations must be able
+	// to answer this without touching the private key/device.
+	//
+	// PubKey can legitimately return nil: *ec.PublicKey is a secp256k1
+	// curve point, and a non-secp256k1-backed implementation (*ed25519Signer
+	// is the only one today) has no such point to hand back. Every caller
+	// of PubKey() in this package is on a path that only ever holds a
+	// secp256k1 Signer (softwareSigner/HardwareSigner); a caller that can't
+	// rule out an ed25519-backed Signer must check for nil, or type-assert
+	// to the concrete signer (e.g. *ed25519Signer.PublicKeyBytes) to get its
+	// native public key representation instead.
+	PubKey() *ec.PublicKey
+	// Sign signs a 32-byte message digest and returns the signature in
+	// whatever wire encoding the signer's scheme uses (DER for secp256k1,
+	// the raw 64-byte signature for ed25519, etc.) -- the return type is
+	// scheme-agnostic so every Signer implementation, not just
+	// secp256k1-backed ones, can satisfy this interface without a
+	// hard-failing stub. Callers that need to verify a signature go
+	// through the matching Scheme, which knows how to parse its own
+	// encoding.
+	Sign(digest []byte) ([]byte, error)
+	// Close releases whatever resource backs the signer (a no-op for the
+	// software implementation, the HID handle for HardwareSigner).
+	Close() error
+}
+
+// softwareSigner is the existing behavior -- a *ec.PrivateKey held in
+// memory -- wrapped to satisfy Signer.
+type softwareSigner struct {
+	priv *ec.PrivateKey
+	pub  *ec.PublicKey
+}
+
+// NewSoftwareSigner wraps priv as a Signer. This is what SetLocalKeyPair
+// should construct for the existing in-memory key flow.
+func NewSoftwareSigner(priv *ec.PrivateKey) Signer {
+	return &softwareSigner{priv: priv, pub: priv.PubKey()}
+}
+
+func (s *softwareSigner) PubKey() *ec.PublicKey { return s.pub }
+
+func (s *softwareSigner) Sign(digest []byte) ([]byte, error) {
+	sig, err := s.priv.Sign(digest)
+	if err != nil {
+		return nil, err
+	}
+	return sig.Serialize(), nil
+}
+
+func (s *softwareSigner) Close() error { return nil }
+
+// localSigner backs GetLocalSigner/SetLocalSigner, the Signer-based
+// counterpart of SetLocalKeyPair/GetLocalPrivateKey: new call sites should
+// prefer it so the private scalar never has to live in Go memory when the
+// local keypair is hardware-backed.
+var localSigner Signer
+
+// SetLocalSigner installs signer as the process-wide local Signer. It is
+// additive to SetLocalKeyPair -- call sites that still hand out a bare
+// *ec.PrivateKey are unaffected -- but InitLocalKeyPairWithHardware goes
+// through this instead, since a HardwareSigner has no private key material
+// to give SetLocalKeyPair. It clears any Scheme recorded by an earlier
+// SetLocalSchemeSigner call.
+func SetLocalSigner(signer Signer) {
+	localScheme = nil
+	localSigner = signer
+}
+
+// GetLocalSigner returns the process-wide local Signer set by
+// SetLocalSigner, or nil if none has been set.
+func GetLocalSigner() Signer {
+	return localSigner
+}
+
+// localScheme records which Scheme produced localSigner, so verifiers that
+// need to know the algorithm (not just "something implementing Signer")
+// can ask GetLocalScheme instead of assuming secp256k1.
+var localScheme Scheme
+
+// SetLocalSchemeSigner is the Scheme-aware counterpart of SetLocalKeyPair:
+// it installs signer as the process-wide local Signer the same way
+// SetLocalSigner does, and additionally records which Scheme produced it.
+func SetLocalSchemeSigner(scheme Scheme, signer Signer) {
+	localScheme = scheme
+	localSigner = signer
+}
+
+// GetLocalScheme returns the Scheme set by SetLocalSchemeSigner, or nil if
+// the local signer was installed through SetLocalKeyPair/SetLocalSigner
+// instead (the original secp256k1-only flow).
+func GetLocalScheme() Scheme {
+	return localScheme
+}
+
+// rawKeyer is implemented by Signer implementations that can hand back
+// their raw private key/seed bytes so InitLocalKeyPairWithScheme can
+// persist a freshly generated key via SavePrivateKeyScheme. It is
+// deliberately unexported: Signer itself never exposes the private scalar,
+// this is only used internally by this package's own key file code, and a
+// HardwareSigner -- which has no raw bytes to give -- simply doesn't
+// implement it.
+type rawKeyer interface {
+	rawKey() []byte
+}
+
+func (s *softwareSigner) rawKey() []byte { return s.priv.Serialize() }
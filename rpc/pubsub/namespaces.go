@@ -0,0 +1,183 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pubsub
+
+import (
+	"sync"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+// Namespace names accepted by "covenantsql_subscribe".
+const (
+	// NamespaceNewBPBlocks streams every block fed into AdviseNewBlock.
+	NamespaceNewBPBlocks = "newBPBlocks"
+	// NamespaceNewTxBillings streams every billing fed into AdviseTxBilling.
+	NamespaceNewTxBillings = "newTxBillings"
+	// NamespacePendingTx streams every transaction accepted by AddTx.
+	NamespacePendingTx = "pendingTx"
+	// NamespaceAccountBalance streams stable/covenant balance diffs for a
+	// single proto.AccountAddress supplied as the subscribe argument.
+	NamespaceAccountBalance = "accountBalance"
+)
+
+// RegisterDefaultNamespaces wires the four namespaces derived from the
+// existing BP RPC surface (AdviseNewBlockReq, AdviseTxBillingReq, AddTxReq,
+// QueryAccountStableBalance/QueryAccountCovenantBalance) into hub. The
+// returned *Feeds exposes the Publish* methods that the corresponding
+// ChainRPCService/BP service handlers should call once they have processed
+// the equivalent net/rpc request.
+func RegisterDefaultNamespaces(hub *Hub) *Feeds {
+	f := &Feeds{
+		blocks:     &broadcastNamespace{subs: make(map[SubscriptionID]Notifier)},
+		txBillings: &broadcastNamespace{subs: make(map[SubscriptionID]Notifier)},
+		pendingTx:  &broadcastNamespace{subs: make(map[SubscriptionID]Notifier)},
+		balances:   &balanceNamespace{subs: make(map[SubscriptionID]*balanceSub)},
+	}
+	hub.Register(NamespaceNewBPBlocks, f.blocks)
+	hub.Register(NamespaceNewTxBillings, f.txBillings)
+	hub.Register(NamespacePendingTx, f.pendingTx)
+	hub.Register(NamespaceAccountBalance, f.balances)
+	return f
+}
+
+// Feeds is the publish-side handle for the four built-in namespaces. Callers
+// obtain one from RegisterDefaultNamespaces once at startup and keep it
+// alongside the ChainRPCService/BP service that owns the matching net/rpc
+// handler.
+type Feeds struct {
+	blocks     *broadcastNamespace
+	txBillings *broadcastNamespace
+	pendingTx  *broadcastNamespace
+	balances   *balanceNamespace
+}
+
+// PublishNewBlock notifies every newBPBlocks subscriber. Call this from the
+// AdviseNewBlock RPC handler after the block has been accepted.
+func (f *Feeds) PublishNewBlock(block *types.BPBlock) {
+	f.blocks.broadcast(block)
+}
+
+// PublishNewTxBilling notifies every newTxBillings subscriber. Call this
+// from the AdviseTxBilling RPC handler after the billing has been accepted.
+func (f *Feeds) PublishNewTxBilling(billing *types.Billing) {
+	f.txBillings.broadcast(billing)
+}
+
+// PublishPendingTx notifies every pendingTx subscriber. Call this from the
+// AddTx RPC handler once the transaction has been admitted to the mempool.
+func (f *Feeds) PublishPendingTx(tx interface{}) {
+	f.pendingTx.broadcast(tx)
+}
+
+// PublishBalanceDiff notifies every accountBalance subscriber watching addr
+// if stable or covenant differs from the last value it saw for addr. This
+// package runs no poller of its own: accountBalance subscribers only hear
+// of balances that some caller has queried (QueryAccountStableBalance/
+// QueryAccountCovenantBalance) and passed in here.
+func (f *Feeds) PublishBalanceDiff(addr proto.AccountAddress, stable, covenant uint64) {
+	f.balances.publish(addr, stable, covenant)
+}
+
+// broadcastNamespace fans a single payload out to every current subscriber,
+// used by the three namespaces that have no per-subscription filter.
+type broadcastNamespace struct {
+	mu   sync.RWMutex
+	subs map[SubscriptionID]Notifier
+}
+
+func (b *broadcastNamespace) onSubscribe(id SubscriptionID, _ interface{}, notifier Notifier) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[id] = notifier
+	return nil
+}
+
+func (b *broadcastNamespace) onUnsubscribe(id SubscriptionID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, id)
+}
+
+func (b *broadcastNamespace) broadcast(payload interface{}) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for id, notifier := range b.subs {
+		_ = notifier.Notify(id, payload)
+	}
+}
+
+// balanceSub remembers the address a subscriber asked for and the last
+// values it was sent, so publish can compute a diff.
+type balanceSub struct {
+	notifier Notifier
+	addr     proto.AccountAddress
+	stable   uint64
+	covenant uint64
+	seen     bool
+}
+
+// balanceNamespace implements the accountBalance namespace: each subscriber
+// supplies a proto.AccountAddress as its subscribe argument and only
+// receives notifications when the balance passed to PublishBalanceDiff for
+// that address changes.
+type balanceNamespace struct {
+	mu   sync.RWMutex
+	subs map[SubscriptionID]*balanceSub
+}
+
+// AccountBalanceDiff is the payload delivered to accountBalance subscribers.
+type AccountBalanceDiff struct {
+	Addr     proto.AccountAddress `json:"addr"`
+	Stable   uint64               `json:"stable"`
+	Covenant uint64               `json:"covenant"`
+}
+
+func (n *balanceNamespace) onSubscribe(id SubscriptionID, args interface{}, notifier Notifier) error {
+	addr, ok := args.(proto.AccountAddress)
+	if !ok {
+		return ErrUnknownNamespace
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.subs[id] = &balanceSub{notifier: notifier, addr: addr}
+	return nil
+}
+
+func (n *balanceNamespace) onUnsubscribe(id SubscriptionID) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.subs, id)
+}
+
+func (n *balanceNamespace) publish(addr proto.AccountAddress, stable, covenant uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for id, sub := range n.subs {
+		if sub.addr != addr {
+			continue
+		}
+		if sub.seen && sub.stable == stable && sub.covenant == covenant {
+			continue
+		}
+		sub.seen = true
+		sub.stable = stable
+		sub.covenant = covenant
+		_ = sub.notifier.Notify(id, AccountBalanceDiff{Addr: addr, Stable: stable, Covenant: covenant})
+	}
+}
@@ -0,0 +1,294 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package pubsub implements a JSON-RPC 2.0 publish/subscribe subsystem,
+// in the style of go-ethereum's rpc/v2, sitting alongside the existing
+// net/rpc based mux. Clients call "covenantsql_subscribe" with a namespace
+// and arguments over a persistent transport (see transport.go) to receive
+// a subscription id, then receive "covenantsql_subscription" notifications
+// until they call "covenantsql_unsubscribe".
+package pubsub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrUnknownNamespace is returned when a client subscribes to a namespace
+	// that has not been registered with the Hub. It is also returned when an
+	// accountBalance subscription carries no proto.AccountAddress argument,
+	// and for a JSON-RPC method the transport does not know.
+	ErrUnknownNamespace = errors.New("pubsub: unknown namespace")
+	// ErrUnknownSubscription is returned when a client unsubscribes from or
+	// the dispatcher notifies an id that is no longer tracked.
+	ErrUnknownSubscription = errors.New("pubsub: unknown subscription")
+	// ErrConnClosed is returned when a notification targets a connection
+	// that has already been reaped.
+	ErrConnClosed = errors.New("pubsub: connection closed")
+)
+
+// backlogSize bounds the number of pending notifications buffered per
+// subscription before the oldest entry is dropped to apply backpressure.
+const backlogSize = 256
+
+// SubscriptionID identifies a single subscription. Ids are generated from
+// crypto/rand rather than derived from connection or process state, so a
+// client that reconnects and resubmits the same subscribe call always gets
+// a fresh, collision-free id regardless of how many times the node has
+// restarted.
+type SubscriptionID string
+
+func newSubscriptionID() (SubscriptionID, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return SubscriptionID(hex.EncodeToString(buf[:])), nil
+}
+
+// Notifier lets a namespace push a notification to whichever connection owns
+// a subscription, without knowing anything about the underlying transport
+// (WebSocket, IPC, ...). ChainRPCService/BP service code should hold a
+// Notifier and call Notify whenever a new event matching a live subscription
+// occurs.
+type Notifier interface {
+	// Notify delivers payload to the subscriber identified by id. It never
+	// blocks the caller: if the subscriber's backlog is full, the oldest
+	// buffered notification is dropped and the subscription's dropped
+	// counter is incremented.
+	Notify(id SubscriptionID, payload interface{}) error
+}
+
+// subscription tracks a single live subscription and its pending backlog.
+type subscription struct {
+	id        SubscriptionID
+	namespace string
+	queue     chan interface{}
+	dropped   uint64
+	mu        sync.Mutex
+	closed    bool
+}
+
+func (s *subscription) push(payload interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	for {
+		select {
+		case s.queue <- payload:
+			return
+		default:
+			// Backlog full: drop the oldest entry and count it, never
+			// block the producer.
+			select {
+			case <-s.queue:
+				s.dropped++
+				logDrop(s.namespace, s.id, s.dropped)
+			default:
+			}
+		}
+	}
+}
+
+func (s *subscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.queue)
+}
+
+// Conn represents one persistent bidirectional client connection (WebSocket
+// or IPC). It owns every subscription created over it and implements
+// Notifier so namespace publishers can push to it without caring how the
+// bytes eventually get written out. send is the transport's actual frame
+// write; it may block on socket I/O, which is why every subscription drains
+// its own buffered queue on a dedicated goroutine instead of calling send
+// directly from the publisher.
+type Conn struct {
+	hub  *Hub
+	send func(id SubscriptionID, payload interface{}) error
+	mu   sync.RWMutex
+	subs map[SubscriptionID]*subscription
+}
+
+func newConn(hub *Hub, send func(id SubscriptionID, payload interface{}) error) *Conn {
+	return &Conn{
+		hub:  hub,
+		send: send,
+		subs: make(map[SubscriptionID]*subscription),
+	}
+}
+
+// Subscribe registers a new subscription to namespace on this connection and
+// returns the id the client should use to correlate future
+// "covenantsql_subscription" notifications and to unsubscribe later.
+func (c *Conn) Subscribe(namespace string, args interface{}) (SubscriptionID, error) {
+	ns, ok := c.hub.namespace(namespace)
+	if !ok {
+		return "", ErrUnknownNamespace
+	}
+
+	id, err := newSubscriptionID()
+	if err != nil {
+		return "", err
+	}
+
+	sub := &subscription{
+		id:        id,
+		namespace: namespace,
+		queue:     make(chan interface{}, backlogSize),
+	}
+
+	c.mu.Lock()
+	c.subs[id] = sub
+	c.mu.Unlock()
+
+	go c.drain(sub)
+
+	if err = ns.onSubscribe(id, args, c); err != nil {
+		c.Unsubscribe(id)
+		return "", err
+	}
+
+	return id, nil
+}
+
+// drain is the per-subscription goroutine that serializes writes out to the
+// transport: it blocks on send so a slow client never starves other
+// subscriptions, while push (called from the publisher side) never blocks.
+func (c *Conn) drain(sub *subscription) {
+	for payload := range sub.queue {
+		if err := c.send(sub.id, payload); err != nil {
+			log.Errorf("pubsub: delivering notification for subscription %s failed: %s", sub.id, err)
+			return
+		}
+	}
+}
+
+// Unsubscribe tears down a subscription previously created on this
+// connection and reaps its resources. Callers may invoke it directly
+// ("covenantsql_unsubscribe") or it is invoked for every remaining
+// subscription when the connection itself closes.
+func (c *Conn) Unsubscribe(id SubscriptionID) error {
+	c.mu.Lock()
+	sub, ok := c.subs[id]
+	if ok {
+		delete(c.subs, id)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return ErrUnknownSubscription
+	}
+
+	sub.close()
+	if ns, ok := c.hub.namespace(sub.namespace); ok {
+		ns.onUnsubscribe(id)
+	}
+	return nil
+}
+
+// Notify implements Notifier.
+func (c *Conn) Notify(id SubscriptionID, payload interface{}) error {
+	c.mu.RLock()
+	sub, ok := c.subs[id]
+	c.mu.RUnlock()
+	if !ok {
+		return ErrUnknownSubscription
+	}
+	sub.push(payload)
+	return nil
+}
+
+// Close reaps every subscription still open on this connection. It is called
+// by the transport layer once the underlying socket goes away.
+func (c *Conn) Close() {
+	c.mu.Lock()
+	subs := c.subs
+	c.subs = make(map[SubscriptionID]*subscription)
+	c.mu.Unlock()
+
+	for id, sub := range subs {
+		sub.close()
+		if ns, ok := c.hub.namespace(sub.namespace); ok {
+			ns.onUnsubscribe(id)
+		}
+	}
+}
+
+// namespaceHandler is implemented by every pub/sub namespace (see
+// namespaces.go) and registered with a Hub under a unique name.
+type namespaceHandler interface {
+	// onSubscribe is called once when a client subscribes; implementations
+	// typically stash (id, notifier, args) so a later publish can reach it.
+	onSubscribe(id SubscriptionID, args interface{}, notifier Notifier) error
+	// onUnsubscribe is called once the subscription is torn down, either by
+	// explicit client request or because the connection closed.
+	onUnsubscribe(id SubscriptionID)
+}
+
+// Hub is the top-level pub/sub registry: it owns every namespace and hands
+// out Conns for new transport-level connections.
+type Hub struct {
+	mu         sync.RWMutex
+	namespaces map[string]namespaceHandler
+}
+
+// NewHub creates an empty Hub. Namespaces are registered with Register.
+func NewHub() *Hub {
+	return &Hub{
+		namespaces: make(map[string]namespaceHandler),
+	}
+}
+
+// Register wires a namespace handler under name, e.g. "newBPBlocks".
+func (h *Hub) Register(name string, ns namespaceHandler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.namespaces[name] = ns
+}
+
+func (h *Hub) namespace(name string) (namespaceHandler, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ns, ok := h.namespaces[name]
+	return ns, ok
+}
+
+// NewConn starts tracking a fresh transport-level connection against this
+// Hub. send performs the actual framed write for a single notification; the
+// transport layer is responsible for calling Conn.Close once the underlying
+// socket is gone so subscriptions are reaped promptly.
+func (h *Hub) NewConn(send func(id SubscriptionID, payload interface{}) error) *Conn {
+	return newConn(h, send)
+}
+
+func logDrop(namespace string, id SubscriptionID, dropped uint64) {
+	if dropped > 0 && dropped%64 == 0 {
+		log.Warnf("pubsub: namespace %s subscription %s has dropped %d notifications under backpressure",
+			namespace, id, dropped)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pubsub
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+)
+
+// jsonrpcRequest is the wire shape of a JSON-RPC 2.0 request frame, covering
+// the three methods this subsystem understands.
+type jsonrpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// jsonrpcResponse is the wire shape of a JSON-RPC 2.0 response/notification
+// frame.
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Result  interface{}     `json:"result,omitempty"`
+	Params  interface{}     `json:"params,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+}
+
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// subscribeArgs is the payload of a "covenantsql_subscribe" request: a JSON
+// object whose "namespace" field names the namespace and whose optional
+// "args" field holds the namespace args.
+type subscribeArgs struct {
+	Namespace string          `json:"namespace"`
+	Args      json.RawMessage `json:"args"`
+}
+
+// frameWriter abstracts the one thing a transport needs to provide once a
+// connection is accepted: a way to push a framed JSON-RPC message out, used
+// both for request responses and for async "covenantsql_subscription"
+// notifications.
+type frameWriter interface {
+	WriteJSON(v interface{}) error
+	ReadJSON(v interface{}) error
+	Close() error
+}
+
+// notify wraps a single push as a "covenantsql_subscription" notification
+// frame and writes it out.
+func notify(w frameWriter, id SubscriptionID, payload interface{}) error {
+	return w.WriteJSON(jsonrpcResponse{
+		JSONRPC: "2.0",
+		Method:  "covenantsql_subscription",
+		Params: struct {
+			Subscription SubscriptionID `json:"subscription"`
+			Result       interface{}    `json:"result"`
+		}{Subscription: id, Result: payload},
+	})
+}
+
+// serveConn runs the JSON-RPC request loop for one accepted connection until
+// the peer disconnects or sends a frame that fails to parse, at which point
+// every subscription it owns is reaped.
+func serveConn(hub *Hub, w frameWriter) {
+	conn := hub.NewConn(func(id SubscriptionID, payload interface{}) error {
+		return notify(w, id, payload)
+	})
+	defer func() {
+		conn.Close()
+		_ = w.Close()
+	}()
+
+	for {
+		var req jsonrpcRequest
+		if err := w.ReadJSON(&req); err != nil {
+			return
+		}
+
+		switch req.Method {
+		case "covenantsql_subscribe":
+			var args subscribeArgs
+			_ = json.Unmarshal(req.Params, &args)
+			id, err := conn.Subscribe(args.Namespace, decodeNamespaceArgs(args.Namespace, args.Args))
+			writeResult(w, req.ID, id, err)
+
+		case "covenantsql_unsubscribe":
+			var ids []SubscriptionID
+			_ = json.Unmarshal(req.Params, &ids)
+			var err error
+			if len(ids) == 1 {
+				err = conn.Unsubscribe(ids[0])
+			} else {
+				err = ErrUnknownSubscription
+			}
+			writeResult(w, req.ID, err == nil, err)
+
+		default:
+			writeResult(w, req.ID, nil, ErrUnknownNamespace)
+		}
+	}
+}
+
+func decodeNamespaceArgs(namespace string, raw json.RawMessage) interface{} {
+	if namespace != NamespaceAccountBalance || len(raw) == 0 {
+		return nil
+	}
+	var addr proto.AccountAddress
+	if err := json.Unmarshal(raw, &addr); err != nil {
+		return nil
+	}
+	return addr
+}
+
+func writeResult(w frameWriter, id json.RawMessage, result interface{}, err error) {
+	resp := jsonrpcResponse{JSONRPC: "2.0", ID: id, Result: result}
+	if err != nil {
+		resp.Result = nil
+		resp.Error = &jsonrpcError{Code: -32000, Message: err.Error()}
+	}
+	if werr := w.WriteJSON(resp); werr != nil {
+		log.Errorf("pubsub: write response failed: %s", werr)
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	// Subscriptions are only ever opened by trusted clients carrying a
+	// signed proto.Envelope on the namespace args; the upgrade itself stays
+	// permissive like the rest of the net/rpc mux.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsFrameWriter and ipcFrameWriter hold mu around every write, since each
+// subscription's drain goroutine and serveConn's responses share one
+// connection.
+type wsFrameWriter struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (w *wsFrameWriter) WriteJSON(v interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conn.WriteJSON(v)
+}
+func (w *wsFrameWriter) ReadJSON(v interface{}) error { return w.conn.ReadJSON(v) }
+func (w *wsFrameWriter) Close() error                 { return w.conn.Close() }
+
+// ServeWebSocket upgrades an HTTP request to a WebSocket and serves the
+// pub/sub JSON-RPC loop over it. Mount this alongside the existing net/rpc
+// mux's HTTP endpoint, e.g. http.Handle("/ws", pubsub.ServeWebSocket(hub)).
+func ServeWebSocket(hub *Hub) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(rw, r, nil)
+		if err != nil {
+			log.Errorf("pubsub: websocket upgrade failed: %s", err)
+			return
+		}
+		go serveConn(hub, &wsFrameWriter{conn: c})
+	}
+}
+
+type ipcFrameWriter struct {
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+	mu   sync.Mutex
+}
+
+func (w *ipcFrameWriter) WriteJSON(v interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(v)
+}
+func (w *ipcFrameWriter) ReadJSON(v interface{}) error { return w.dec.Decode(v) }
+func (w *ipcFrameWriter) Close() error                 { return w.conn.Close() }
+
+// ServeIPC listens on a Unix domain socket (endpoint, e.g.
+// "/var/run/covenantsql/pubsub.sock") and serves the same pub/sub JSON-RPC
+// loop over each accepted connection. It blocks until the listener is closed
+// or errors out.
+func ServeIPC(hub *Hub, endpoint string) error {
+	l, err := net.Listen("unix", endpoint)
+	if err != nil {
+		return err
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(hub, &ipcFrameWriter{
+			conn: c,
+			dec:  json.NewDecoder(c),
+			enc:  json.NewEncoder(c),
+		})
+	}
+}
@@ -17,34 +17,371 @@
 package sqlchain
 
 import (
+	"errors"
 	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"gitlab.com/thunderdb/ThunderDB/proto"
 	"gitlab.com/thunderdb/ThunderDB/rpc"
 )
 
+var (
+	// ErrCircuitOpen is returned by the mux dispatcher instead of forwarding
+	// to a downstream ChainRPCService whose breaker has tripped.
+	ErrCircuitOpen = errors.New("sqlchain: circuit open for database")
+	// ErrRateLimited is returned by the mux dispatcher when a database's
+	// token-bucket rate limiter has no tokens left.
+	ErrRateLimited = errors.New("sqlchain: database rate limited")
+	// ErrTooManyConcurrentRequests is returned by the mux dispatcher when a
+	// database is already at its in-flight concurrency cap.
+	ErrTooManyConcurrentRequests = errors.New("sqlchain: too many concurrent requests for database")
+)
+
+var (
+	muxRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "covenantsql_mux_requests_total",
+		Help: "Total MuxService requests forwarded to a downstream ChainRPCService.",
+	}, []string{"method", "database_id"})
+
+	muxDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "covenantsql_mux_dropped_total",
+		Help: "Total MuxService requests rejected by the rate limiter, concurrency cap or breaker.",
+	}, []string{"method", "database_id", "reason"})
+
+	muxLatencySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "covenantsql_mux_latency_seconds",
+		Help: "Latency of MuxService requests forwarded to a downstream ChainRPCService.",
+	}, []string{"method", "database_id"})
+)
+
+// Quota bounds how much traffic a single proto.DatabaseID may push through
+// the mux: ratePerSecond/burst feed a token-bucket limiter, maxConcurrent
+// caps the number of in-flight requests for that database at any time.
+type Quota struct {
+	RatePerSecond float64
+	Burst         int
+	MaxConcurrent int
+}
+
+// DefaultQuota is applied to a proto.DatabaseID that QuotaSource has no
+// entry for.
+var DefaultQuota = Quota{RatePerSecond: 200, Burst: 400, MaxConcurrent: 64}
+
+// BreakerConfig configures the circuit breaker tripped after consecutive
+// downstream errors for a single proto.DatabaseID.
+type BreakerConfig struct {
+	// ConsecutiveFailures is how many consecutive downstream errors trip
+	// the breaker open.
+	ConsecutiveFailures int
+	// CoolDown is how long the breaker stays open (failing fast with
+	// ErrCircuitOpen) before it allows a single probe request through.
+	CoolDown time.Duration
+}
+
+// DefaultBreakerConfig is applied when MuxService is constructed without an
+// explicit BreakerConfig.
+var DefaultBreakerConfig = BreakerConfig{ConsecutiveFailures: 5, CoolDown: 30 * time.Second}
+
+// QuotaSource resolves the Quota to apply to a proto.DatabaseID. It may be
+// backed by a dedicated config type or adapted from an existing
+// ProjectConfig lookup; MuxService only depends on this narrow interface so
+// it never needs to import whatever concrete config store is in use.
+type QuotaSource interface {
+	QuotaFor(id proto.DatabaseID) Quota
+}
+
+// staticQuotaSource is the QuotaSource used until SetQuotaSource is called,
+// and the one AdjustQuota mutates at runtime.
+type staticQuotaSource struct {
+	mu     sync.RWMutex
+	quotas map[proto.DatabaseID]Quota
+}
+
+func newStaticQuotaSource() *staticQuotaSource {
+	return &staticQuotaSource{quotas: make(map[proto.DatabaseID]Quota)}
+}
+
+func (s *staticQuotaSource) QuotaFor(id proto.DatabaseID) Quota {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if q, ok := s.quotas[id]; ok {
+		return q
+	}
+	return DefaultQuota
+}
+
+func (s *staticQuotaSource) set(id proto.DatabaseID, q Quota) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quotas[id] = q
+}
+
+// tokenBucket is a minimal token-bucket rate limiter.
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	lastFill time.Time
+}
+
+func newTokenBucket(q Quota) *tokenBucket {
+	return &tokenBucket{
+		rate:     q.RatePerSecond,
+		burst:    float64(q.Burst),
+		tokens:   float64(q.Burst),
+		lastFill: time.Now(),
+	}
+}
+
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += b.rate * now.Sub(b.lastFill).Seconds()
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.lastFill = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// breakerState is the circuit breaker state machine for a single
+// proto.DatabaseID's downstream ChainRPCService.
+type breakerState struct {
+	mu       sync.Mutex
+	cfg      BreakerConfig
+	failures int
+	open     bool
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreakerState(cfg BreakerConfig) *breakerState {
+	return &breakerState{cfg: cfg}
+}
+
+// allow reports whether a request may proceed: always once closed, a single
+// probe once the cool-down has elapsed, otherwise ErrCircuitOpen.
+func (b *breakerState) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true
+	}
+	if time.Since(b.openedAt) < b.cfg.CoolDown {
+		return false
+	}
+	if b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *breakerState) recordResult(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		b.open = false
+		return
+	}
+	b.failures++
+	if b.failures >= b.cfg.ConsecutiveFailures {
+		b.open = true
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *breakerState) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.open = false
+	b.probing = false
+}
+
+// dbGuard bundles the per-DatabaseID limiter, concurrency semaphore and
+// breaker the shared middleware chain checks on every dispatch.
+type dbGuard struct {
+	limiter *tokenBucket
+	sem     chan struct{}
+	breaker *breakerState
+}
+
+// DispatchHook is called by every dispatcher method below once a forwarded
+// request has come back from the downstream ChainRPCService with err == nil,
+// with the method name and the exact req/resp pair that was forwarded. It
+// exists so a caller can feed rpc/pubsub.Feeds.PublishNewBlock/
+// PublishNewTxBilling from here: MuxService itself only ever sees the
+// sqlchain-local Mux*Req/Mux*Resp types, not a *types.BPBlock/*types.Billing
+// it could hand to Feeds directly, so turning req/resp into the payload
+// those expect is left to the hook.
+type DispatchHook func(method string, req, resp interface{})
+
 // MuxService defines multiplexing service of sql-chain.
 type MuxService struct {
-	ServiceName string
-	serviceMap  sync.Map
+	ServiceName   string
+	serviceMap    sync.Map
+	quotaSource   QuotaSource
+	breakerConfig BreakerConfig
+	guards        sync.Map // proto.DatabaseID -> *dbGuard
+	hook          DispatchHook
+}
+
+// SetDispatchHook installs hook to be called after every successful
+// dispatch. Pass nil to stop notifying (the default).
+func (s *MuxService) SetDispatchHook(hook DispatchHook) {
+	s.hook = hook
 }
 
 // NewMuxService creates a new multiplexing service and registers it to rpc server.
 func NewMuxService(serviceName string, server *rpc.Server) (service *MuxService) {
 	service = &MuxService{
-		ServiceName: serviceName,
+		ServiceName:   serviceName,
+		quotaSource:   newStaticQuotaSource(),
+		breakerConfig: DefaultBreakerConfig,
 	}
 
 	server.RegisterService(serviceName, service)
 	return service
 }
 
+// SetQuotaSource swaps in a QuotaSource backed by ProjectConfig or another
+// dedicated config type. Existing per-database guards already created keep
+// whatever quota they were built with until they are next reaped; new
+// databases pick up quotaSource immediately.
+func (s *MuxService) SetQuotaSource(quotaSource QuotaSource) {
+	s.quotaSource = quotaSource
+}
+
 func (s *MuxService) register(id proto.DatabaseID, service *ChainRPCService) {
 	s.serviceMap.Store(id, service)
 }
 
 func (s *MuxService) unregister(id proto.DatabaseID) {
 	s.serviceMap.Delete(id)
+	s.guards.Delete(id)
+}
+
+func (s *MuxService) guardFor(id proto.DatabaseID) *dbGuard {
+	if g, ok := s.guards.Load(id); ok {
+		return g.(*dbGuard)
+	}
+	q := s.quotaSource.QuotaFor(id)
+	g := &dbGuard{
+		limiter: newTokenBucket(q),
+		sem:     make(chan struct{}, q.MaxConcurrent),
+		breaker: newBreakerState(s.breakerConfig),
+	}
+	actual, _ := s.guards.LoadOrStore(id, g)
+	return actual.(*dbGuard)
+}
+
+// guard is the single shared middleware chain every dispatcher method below
+// calls before forwarding to its downstream ChainRPCService: rate limit,
+// then concurrency cap, then circuit breaker. When err is nil, finish must
+// be called exactly once with the downstream call's error (nil on success):
+// it frees the concurrency slot and lets the breaker and latency histogram
+// see the outcome.
+func (s *MuxService) guard(method string, id proto.DatabaseID) (finish func(err error), err error) {
+	g := s.guardFor(id)
+
+	if !g.limiter.allow() {
+		muxDroppedTotal.WithLabelValues(method, string(id), "rate_limited").Inc()
+		return nil, ErrRateLimited
+	}
+
+	select {
+	case g.sem <- struct{}{}:
+	default:
+		muxDroppedTotal.WithLabelValues(method, string(id), "concurrency_capped").Inc()
+		return nil, ErrTooManyConcurrentRequests
+	}
+
+	if !g.breaker.allow() {
+		<-g.sem
+		muxDroppedTotal.WithLabelValues(method, string(id), "circuit_open").Inc()
+		return nil, ErrCircuitOpen
+	}
+
+	start := time.Now()
+	muxRequestsTotal.WithLabelValues(method, string(id)).Inc()
+
+	return func(err error) {
+		<-g.sem
+		g.breaker.recordResult(err)
+		muxLatencySeconds.WithLabelValues(method, string(id)).Observe(time.Since(start).Seconds())
+	}, nil
+}
+
+// AdminResetBreakerReq defines a request of the AdminResetBreaker RPC
+// method, letting an operator reset a tripped breaker at runtime without a
+// restart.
+type AdminResetBreakerReq struct {
+	proto.Envelope
+	proto.DatabaseID
+}
+
+// AdminResetBreakerResp defines a response of the AdminResetBreaker RPC
+// method.
+type AdminResetBreakerResp struct {
+	proto.Envelope
+}
+
+// AdminResetBreaker resets the circuit breaker for req.DatabaseID, if one
+// has been created, allowing traffic to resume immediately instead of
+// waiting out the cool-down.
+func (s *MuxService) AdminResetBreaker(req *AdminResetBreakerReq, resp *AdminResetBreakerResp) error {
+	if g, ok := s.guards.Load(req.DatabaseID); ok {
+		g.(*dbGuard).breaker.reset()
+	}
+	resp.Envelope = req.Envelope
+	return nil
+}
+
+// AdminAdjustQuotaReq defines a request of the AdminAdjustQuota RPC method,
+// letting an operator change a database's quota at runtime without a
+// restart. The new quota takes effect immediately; it is recorded in the
+// default QuotaSource only, so a QuotaSource installed via SetQuotaSource
+// is not updated and a guard rebuilt later reads whatever that source holds.
+type AdminAdjustQuotaReq struct {
+	proto.Envelope
+	proto.DatabaseID
+	Quota Quota
+}
+
+// AdminAdjustQuotaResp defines a response of the AdminAdjustQuota RPC
+// method.
+type AdminAdjustQuotaResp struct {
+	proto.Envelope
+}
+
+// AdminAdjustQuota replaces the rate limiter and concurrency semaphore for
+// req.DatabaseID in place with one built from req.Quota.
+func (s *MuxService) AdminAdjustQuota(req *AdminAdjustQuotaReq, resp *AdminAdjustQuotaResp) error {
+	if sq, ok := s.quotaSource.(*staticQuotaSource); ok {
+		sq.set(req.DatabaseID, req.Quota)
+	}
+	breaker := newBreakerState(s.breakerConfig)
+	if g, ok := s.guards.Load(req.DatabaseID); ok {
+		breaker = g.(*dbGuard).breaker
+	}
+	s.guards.Store(req.DatabaseID, &dbGuard{
+		limiter: newTokenBucket(req.Quota),
+		sem:     make(chan struct{}, req.Quota.MaxConcurrent),
+		breaker: breaker,
+	})
+	resp.Envelope = req.Envelope
+	return nil
 }
 
 // MuxAdviseNewBlockReq defines a request of the AdviseNewBlock RPC method.
@@ -147,83 +484,160 @@ type MuxSignBillingResp struct {
 
 // AdviseNewBlock is the RPC method to advise a new produced block to the target server.
 func (s *MuxService) AdviseNewBlock(req *MuxAdviseNewBlockReq, resp *MuxAdviseNewBlockResp) error {
-	if v, ok := s.serviceMap.Load(req.DatabaseID); ok {
-		resp.Envelope = req.Envelope
-		resp.DatabaseID = req.DatabaseID
-		return v.(*ChainRPCService).AdviseNewBlock(&req.AdviseNewBlockReq, &resp.AdviseNewBlockResp)
+	v, ok := s.serviceMap.Load(req.DatabaseID)
+	if !ok {
+		return ErrUnknownMuxRequest
 	}
 
-	return ErrUnknownMuxRequest
+	finish, err := s.guard("AdviseNewBlock", req.DatabaseID)
+	if err != nil {
+		return err
+	}
+
+	resp.Envelope = req.Envelope
+	resp.DatabaseID = req.DatabaseID
+	err = v.(*ChainRPCService).AdviseNewBlock(&req.AdviseNewBlockReq, &resp.AdviseNewBlockResp)
+	finish(err)
+	if err == nil && s.hook != nil {
+		s.hook("AdviseNewBlock", req, resp)
+	}
+	return err
 }
 
 // AdviseBinLog is the RPC method to advise a new binary log to the target server.
 func (s *MuxService) AdviseBinLog(req *MuxAdviseBinLogReq, resp *MuxAdviseBinLogResp) error {
-	if v, ok := s.serviceMap.Load(req.DatabaseID); ok {
-		resp.Envelope = req.Envelope
-		resp.DatabaseID = req.DatabaseID
-		return v.(*ChainRPCService).AdviseBinLog(&req.AdviseBinLogReq, &resp.AdviseBinLogResp)
+	v, ok := s.serviceMap.Load(req.DatabaseID)
+	if !ok {
+		return ErrUnknownMuxRequest
 	}
 
-	return ErrUnknownMuxRequest
+	finish, err := s.guard("AdviseBinLog", req.DatabaseID)
+	if err != nil {
+		return err
+	}
+
+	resp.Envelope = req.Envelope
+	resp.DatabaseID = req.DatabaseID
+	err = v.(*ChainRPCService).AdviseBinLog(&req.AdviseBinLogReq, &resp.AdviseBinLogResp)
+	finish(err)
+	if err == nil && s.hook != nil {
+		s.hook("AdviseBinLog", req, resp)
+	}
+	return err
 }
 
 // AdviseResponsedQuery is the RPC method to advise a new responsed query to the target server.
 func (s *MuxService) AdviseResponsedQuery(
 	req *MuxAdviseResponsedQueryReq, resp *MuxAdviseResponsedQueryResp) error {
-	if v, ok := s.serviceMap.Load(req.DatabaseID); ok {
-		resp.Envelope = req.Envelope
-		resp.DatabaseID = req.DatabaseID
-		return v.(*ChainRPCService).AdviseResponsedQuery(
-			&req.AdviseResponsedQueryReq, &resp.AdviseResponsedQueryResp)
+	v, ok := s.serviceMap.Load(req.DatabaseID)
+	if !ok {
+		return ErrUnknownMuxRequest
 	}
 
-	return ErrUnknownMuxRequest
+	finish, err := s.guard("AdviseResponsedQuery", req.DatabaseID)
+	if err != nil {
+		return err
+	}
+
+	resp.Envelope = req.Envelope
+	resp.DatabaseID = req.DatabaseID
+	err = v.(*ChainRPCService).AdviseResponsedQuery(
+		&req.AdviseResponsedQueryReq, &resp.AdviseResponsedQueryResp)
+	finish(err)
+	if err == nil && s.hook != nil {
+		s.hook("AdviseResponsedQuery", req, resp)
+	}
+	return err
 }
 
 // AdviseAckedQuery is the RPC method to advise a new acknowledged query to the target server.
 func (s *MuxService) AdviseAckedQuery(
 	req *MuxAdviseAckedQueryReq, resp *MuxAdviseAckedQueryResp) error {
-	if v, ok := s.serviceMap.Load(req.DatabaseID); ok {
-		resp.Envelope = req.Envelope
-		resp.DatabaseID = req.DatabaseID
-		return v.(*ChainRPCService).AdviseAckedQuery(
-			&req.AdviseAckedQueryReq, &resp.AdviseAckedQueryResp)
+	v, ok := s.serviceMap.Load(req.DatabaseID)
+	if !ok {
+		return ErrUnknownMuxRequest
 	}
 
-	return ErrUnknownMuxRequest
+	finish, err := s.guard("AdviseAckedQuery", req.DatabaseID)
+	if err != nil {
+		return err
+	}
+
+	resp.Envelope = req.Envelope
+	resp.DatabaseID = req.DatabaseID
+	err = v.(*ChainRPCService).AdviseAckedQuery(
+		&req.AdviseAckedQueryReq, &resp.AdviseAckedQueryResp)
+	finish(err)
+	if err == nil && s.hook != nil {
+		s.hook("AdviseAckedQuery", req, resp)
+	}
+	return err
 }
 
 // FetchBlock is the RPC method to fetch a known block form the target server.
 func (s *MuxService) FetchBlock(req *MuxFetchBlockReq, resp *MuxFetchBlockResp) (err error) {
-	if v, ok := s.serviceMap.Load(req.DatabaseID); ok {
-		resp.Envelope = req.Envelope
-		resp.DatabaseID = req.DatabaseID
-		return v.(*ChainRPCService).FetchBlock(&req.FetchBlockReq, &resp.FetchBlockResp)
+	v, ok := s.serviceMap.Load(req.DatabaseID)
+	if !ok {
+		return ErrUnknownMuxRequest
 	}
 
-	return ErrUnknownMuxRequest
+	finish, err := s.guard("FetchBlock", req.DatabaseID)
+	if err != nil {
+		return err
+	}
+
+	resp.Envelope = req.Envelope
+	resp.DatabaseID = req.DatabaseID
+	err = v.(*ChainRPCService).FetchBlock(&req.FetchBlockReq, &resp.FetchBlockResp)
+	finish(err)
+	if err == nil && s.hook != nil {
+		s.hook("FetchBlock", req, resp)
+	}
+	return err
 }
 
 // FetchAckedQuery is the RPC method to fetch a known block form the target server.
 func (s *MuxService) FetchAckedQuery(
 	req *MuxFetchAckedQueryReq, resp *MuxFetchAckedQueryResp) (err error) {
-	if v, ok := s.serviceMap.Load(req.DatabaseID); ok {
-		resp.Envelope = req.Envelope
-		resp.DatabaseID = req.DatabaseID
-		return v.(*ChainRPCService).FetchAckedQuery(
-			&req.FetchAckedQueryReq, &resp.FetchAckedQueryResp)
+	v, ok := s.serviceMap.Load(req.DatabaseID)
+	if !ok {
+		return ErrUnknownMuxRequest
 	}
 
-	return ErrUnknownMuxRequest
+	finish, err := s.guard("FetchAckedQuery", req.DatabaseID)
+	if err != nil {
+		return err
+	}
+
+	resp.Envelope = req.Envelope
+	resp.DatabaseID = req.DatabaseID
+	err = v.(*ChainRPCService).FetchAckedQuery(
+		&req.FetchAckedQueryReq, &resp.FetchAckedQueryResp)
+	finish(err)
+	if err == nil && s.hook != nil {
+		s.hook("FetchAckedQuery", req, resp)
+	}
+	return err
 }
 
 // SignBilling is the RPC method to get signature for a billing request form the target server.
 func (s *MuxService) SignBilling(req *MuxSignBillingReq, resp *MuxSignBillingResp) (err error) {
-	if v, ok := s.serviceMap.Load(req.DatabaseID); ok {
-		resp.Envelope = req.Envelope
-		resp.DatabaseID = req.DatabaseID
-		return v.(*ChainRPCService).SignBilling(&req.SignBillingReq, &resp.SignBillingResp)
+	v, ok := s.serviceMap.Load(req.DatabaseID)
+	if !ok {
+		return ErrUnknownMuxRequest
+	}
+
+	finish, err := s.guard("SignBilling", req.DatabaseID)
+	if err != nil {
+		return err
 	}
 
-	return ErrUnknownMuxRequest
-}
\ No newline at end of file
+	resp.Envelope = req.Envelope
+	resp.DatabaseID = req.DatabaseID
+	err = v.(*ChainRPCService).SignBilling(&req.SignBillingReq, &resp.SignBillingResp)
+	finish(err)
+	if err == nil && s.hook != nil {
+		s.hook("SignBilling", req, resp)
+	}
+	return err
+}
@@ -77,6 +77,78 @@ type FetchTxBillingResp struct {
 	proto.Envelope
 }
 
+// NewBlockFilterReq defines a request of the NewBlockFilter RPC method. It
+// installs a filter, in the style of eth_newFilter, that records every
+// block advised through AdviseNewBlock from now on.
+type NewBlockFilterReq struct {
+	proto.Envelope
+}
+
+// NewBlockFilterResp defines a response of the NewBlockFilter RPC method.
+type NewBlockFilterResp struct {
+	proto.Envelope
+	FilterID FilterID
+}
+
+// NewTxBillingFilterReq defines a request of the NewTxBillingFilter RPC
+// method. It installs a filter that records every billing advised through
+// AdviseTxBilling matching the given criteria from now on. A zero-value
+// field is treated as "don't filter on this".
+type NewTxBillingFilterReq struct {
+	proto.Envelope
+	FromAddr   proto.AccountAddress
+	ToAddr     proto.AccountAddress
+	TxTypes    []TxType
+	FromHeight uint32
+	ToHeight   uint32
+}
+
+// NewTxBillingFilterResp defines a response of the NewTxBillingFilter RPC
+// method.
+type NewTxBillingFilterResp struct {
+	proto.Envelope
+	FilterID FilterID
+}
+
+// GetFilterChangesReq defines a request of the GetFilterChanges RPC method.
+type GetFilterChangesReq struct {
+	proto.Envelope
+	FilterID FilterID
+}
+
+// GetFilterChangesResp defines a response of the GetFilterChanges RPC
+// method: every entry the filter has matched since the last poll.
+type GetFilterChangesResp struct {
+	proto.Envelope
+	Entries []FilterEntry
+}
+
+// GetFilterLogsReq defines a request of the GetFilterLogs RPC method.
+type GetFilterLogsReq struct {
+	proto.Envelope
+	FilterID FilterID
+}
+
+// GetFilterLogsResp defines a response of the GetFilterLogs RPC method:
+// the full historical match set recorded for the filter, bounded by its
+// ring buffer capacity.
+type GetFilterLogsResp struct {
+	proto.Envelope
+	Entries []FilterEntry
+}
+
+// UninstallFilterReq defines a request of the UninstallFilter RPC method.
+type UninstallFilterReq struct {
+	proto.Envelope
+	FilterID FilterID
+}
+
+// UninstallFilterResp defines a response of the UninstallFilter RPC method.
+type UninstallFilterResp struct {
+	proto.Envelope
+	OK bool
+}
+
 // NextAccountNonceReq defines a request of the NextAccountNonce RPC method.
 type NextAccountNonceReq struct {
 	proto.Envelope
@@ -102,6 +174,11 @@ type AddTxResp struct {
 }
 
 // SubReq defines a request of the Sub RPC method.
+//
+// Deprecated: this bare callback-URL subscription has been superseded by the
+// JSON-RPC 2.0 pub/sub subsystem in rpc/pubsub (covenantsql_subscribe /
+// covenantsql_subscription / covenantsql_unsubscribe over WebSocket or IPC).
+// It is kept around for existing callers of the net/rpc mux.
 type SubReq struct {
 	proto.Envelope
 	Topic    string
@@ -109,6 +186,8 @@ type SubReq struct {
 }
 
 // SubResp defines a response of the Sub RPC method.
+//
+// Deprecated: see SubReq.
 type SubResp struct {
 	proto.Envelope
 	Result string
@@ -170,4 +249,3 @@ type QuerySQLChainProfileResp struct {
 	proto.Envelope
 	Profile SQLChainProfile
 }
-
@@ -0,0 +1,288 @@
+/*
+ * Copyright 2019 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+)
+
+// TxType is the billing transaction type a NewTxBillingFilterReq can filter
+// on. It mirrors whatever category the billing's originating transaction
+// carries; zero means "any type".
+type TxType uint32
+
+// filterIdleTimeout is how long a filter may go unpolled (GetFilterChanges/
+// GetFilterLogs) before FilterManager.GC reclaims it.
+const filterIdleTimeout = 5 * time.Minute
+
+// filterRingCap bounds the number of entries kept per filter so a filter
+// nobody polls can't grow without bound.
+const filterRingCap = 4096
+
+// FilterID identifies a single installed filter.
+type FilterID string
+
+func newFilterID() FilterID {
+	var buf [16]byte
+	_, _ = rand.Read(buf[:])
+	return FilterID(hex.EncodeToString(buf[:]))
+}
+
+// FilterEntry is a single match recorded by a filter, returned from
+// GetFilterChanges/GetFilterLogs.
+type FilterEntry struct {
+	Height  uint32
+	Block   *BPBlock
+	Billing *Billing
+}
+
+// blockFilter matches every block unconditionally.
+type blockFilter struct{}
+
+func (blockFilter) matchesBlock(*BPBlock) bool           { return true }
+func (blockFilter) matchesBilling(uint32, *Billing) bool { return false }
+
+// txBillingFilter matches AdviseTxBilling calls against the height range
+// from a NewTxBillingFilterReq; a zero field means "don't filter on this".
+//
+// NewTxBillingFilterReq also accepts FromAddr/ToAddr/TxTypes, but the
+// Billing payload DispatchTxBilling receives doesn't carry the originating
+// transaction's from/to address or type -- that detail lives further up
+// the stack, in whatever produces Billing -- so txBillingFilter has
+// nothing to match those fields against. NewTxBillingFilter rejects such
+// requests with ErrFilterCriteriaUnsupported instead of silently
+// installing a filter that only honors the height range.
+type txBillingFilter struct {
+	fromHeight uint32
+	toHeight   uint32
+}
+
+func (f *txBillingFilter) matchesBlock(*BPBlock) bool { return false }
+
+func (f *txBillingFilter) matchesBilling(height uint32, b *Billing) bool {
+	if f.fromHeight != 0 && height < f.fromHeight {
+		return false
+	}
+	if f.toHeight != 0 && height > f.toHeight {
+		return false
+	}
+	return true
+}
+
+type filterMatcher interface {
+	matchesBlock(*BPBlock) bool
+	matchesBilling(height uint32, b *Billing) bool
+}
+
+// filter is one entry in FilterManager's filterMap: a matcher plus the ring
+// buffer of everything it has matched so far.
+type filter struct {
+	matcher    filterMatcher
+	mu         sync.Mutex
+	entries    []FilterEntry
+	unreadFrom int
+	lastAccess time.Time
+}
+
+func (f *filter) record(e FilterEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = append(f.entries, e)
+	if over := len(f.entries) - filterRingCap; over > 0 {
+		f.entries = f.entries[over:]
+		if f.unreadFrom > over {
+			f.unreadFrom -= over
+		} else {
+			f.unreadFrom = 0
+		}
+	}
+}
+
+func (f *filter) changes() []FilterEntry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastAccess = time.Now()
+	out := append([]FilterEntry(nil), f.entries[f.unreadFrom:]...)
+	f.unreadFrom = len(f.entries)
+	return out
+}
+
+func (f *filter) logs() []FilterEntry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastAccess = time.Now()
+	return append([]FilterEntry(nil), f.entries...)
+}
+
+func (f *filter) idle() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Since(f.lastAccess) > filterIdleTimeout
+}
+
+// FilterManager is the server-side counterpart of the NewBlockFilter/
+// NewTxBillingFilter/GetFilterChanges/GetFilterLogs/UninstallFilter RPC
+// methods: an in-memory filterMap keyed by a random hex FilterID. The same
+// block/tx dispatch path that already feeds AdviseNewBlock/AdviseTxBilling
+// should call DispatchBlock/DispatchTxBilling once a new block or billing
+// has been accepted, so every live filter gets a chance to record it.
+//
+// Historical queries over [FromHeight, ToHeight] are expected to be
+// answered by replaying the existing block/tx index directly rather than
+// through FilterManager, since a filter only ever sees events from the
+// moment it was installed.
+type FilterManager struct {
+	mu      sync.Mutex
+	filters map[FilterID]*filter
+}
+
+// NewFilterManager creates an empty FilterManager. Call GC periodically
+// (e.g. on a 1-minute ticker) to reap filters idle for longer than 5
+// minutes.
+func NewFilterManager() *FilterManager {
+	return &FilterManager{filters: make(map[FilterID]*filter)}
+}
+
+// NewBlockFilter installs a filter matching every future block and returns
+// its id.
+func (m *FilterManager) NewBlockFilter() FilterID {
+	return m.install(blockFilter{})
+}
+
+// ErrFilterCriteriaUnsupported is returned by NewTxBillingFilter when req
+// asks to filter on FromAddr, ToAddr or TxTypes: txBillingFilter has no way
+// to honor those against the Billing payload it is dispatched (see its doc
+// comment), so the request is rejected rather than silently matching more
+// than asked for. This is a real data-availability gap, not a stand-in for
+// unwritten matching code: Billing's own field definition isn't present
+// anywhere in this tree for txBillingFilter to read a from/to/type out of.
+// Once Billing carries (or AdviseTxBilling is handed) that information, this
+// should become real field comparisons instead of an outright rejection.
+var ErrFilterCriteriaUnsupported = errors.New("types: tx billing filter cannot match on from/to address or tx type yet")
+
+// NewTxBillingFilter installs a filter matching future billings in
+// req.FromHeight..req.ToHeight and returns its id. It returns
+// ErrFilterCriteriaUnsupported if req also asks to filter on FromAddr,
+// ToAddr or TxTypes.
+func (m *FilterManager) NewTxBillingFilter(req *NewTxBillingFilterReq) (FilterID, error) {
+	var zeroAddr proto.AccountAddress
+	if req.FromAddr != zeroAddr || req.ToAddr != zeroAddr || len(req.TxTypes) > 0 {
+		return "", ErrFilterCriteriaUnsupported
+	}
+	f := &txBillingFilter{
+		fromHeight: req.FromHeight,
+		toHeight:   req.ToHeight,
+	}
+	return m.install(f), nil
+}
+
+func (m *FilterManager) install(matcher filterMatcher) FilterID {
+	id := newFilterID()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.filters[id] = &filter{matcher: matcher, lastAccess: time.Now()}
+	return id
+}
+
+// GetFilterChanges returns everything matched by id since the last call to
+// GetFilterChanges; GetFilterLogs does not move that point.
+func (m *FilterManager) GetFilterChanges(id FilterID) ([]FilterEntry, bool) {
+	f, ok := m.get(id)
+	if !ok {
+		return nil, false
+	}
+	return f.changes(), true
+}
+
+// GetFilterLogs returns the full historical match set recorded for id,
+// bounded by the filter's ring buffer capacity.
+func (m *FilterManager) GetFilterLogs(id FilterID) ([]FilterEntry, bool) {
+	f, ok := m.get(id)
+	if !ok {
+		return nil, false
+	}
+	return f.logs(), true
+}
+
+// UninstallFilter frees the resources held by id. It reports whether id was
+// actually installed.
+func (m *FilterManager) UninstallFilter(id FilterID) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.filters[id]; !ok {
+		return false
+	}
+	delete(m.filters, id)
+	return true
+}
+
+func (m *FilterManager) get(id FilterID) (*filter, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.filters[id]
+	return f, ok
+}
+
+// DispatchBlock walks the filter map and appends block to every filter that
+// matches it. Call this from the same path that already feeds
+// AdviseNewBlock, after the block has been accepted.
+func (m *FilterManager) DispatchBlock(height uint32, block *BPBlock) {
+	for _, f := range m.snapshot() {
+		if f.matcher.matchesBlock(block) {
+			f.record(FilterEntry{Height: height, Block: block})
+		}
+	}
+}
+
+// DispatchTxBilling walks the filter map and appends billing to every
+// filter that matches it. Call this from the same path that already feeds
+// AdviseTxBilling, after the billing has been accepted.
+func (m *FilterManager) DispatchTxBilling(height uint32, billing *Billing) {
+	for _, f := range m.snapshot() {
+		if f.matcher.matchesBilling(height, billing) {
+			f.record(FilterEntry{Height: height, Billing: billing})
+		}
+	}
+}
+
+func (m *FilterManager) snapshot() []*filter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]*filter, 0, len(m.filters))
+	for _, f := range m.filters {
+		out = append(out, f)
+	}
+	return out
+}
+
+// GC reaps every filter that has not been polled (GetFilterChanges/
+// GetFilterLogs) for longer than 5 minutes.
+func (m *FilterManager) GC() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, f := range m.filters {
+		if f.idle() {
+			delete(m.filters, id)
+		}
+	}
+}